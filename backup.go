@@ -0,0 +1,330 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/release"
+	"helm.sh/helm/v3/pkg/storage/driver"
+)
+
+// maxBackupSize bounds the extracted size of a restored backup.
+const maxBackupSize = 100 << 20
+
+const backupInfoFile = "backup.json"
+
+// backupReleaseFile matches the release records of a backup,
+// releases/<name>.v<version>.json.
+var backupReleaseFile = regexp.MustCompile(`^releases/(.+)\.v([0-9]+)\.json$`)
+
+type backupInfo struct {
+	Namespace string    `json:"namespace"`
+	Driver    string    `json:"driver"`
+	Created   time.Time `json:"created"`
+}
+
+type restoredRelease struct {
+	Release   string `json:"release"`
+	Revisions []int  `json:"revisions"`
+	Reapplied bool   `json:"reapplied"` // manifest of the last deployed revision
+}
+
+func helmDriver() string {
+	if d := os.Getenv("HELM_DRIVER"); d != "" {
+		return d
+	}
+
+	return "secret"
+}
+
+// writeBackup archives the release records of all revisions as they are
+// stored, one json file per revision.
+func writeBackup(w io.Writer, namespace string, releases []*release.Release) error {
+	gw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gw)
+
+	now := time.Now()
+	files := map[string]interface{}{
+		backupInfoFile: &backupInfo{Namespace: namespace, Driver: helmDriver(), Created: now},
+	}
+	for _, rls := range releases {
+		files[fmt.Sprintf("releases/%s.v%d.json", rls.Name, rls.Version)] = rls
+	}
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		data, err := json.Marshal(files[name])
+		if err != nil {
+			return err
+		}
+		err = tw.WriteHeader(&tar.Header{
+			Name:    name,
+			Mode:    0600,
+			Size:    int64(len(data)),
+			ModTime: now,
+		})
+		if err != nil {
+			return err
+		}
+		if _, err := tw.Write(data); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+
+	return gw.Close()
+}
+
+// readBackup returns the release records of a backup archive by release
+// name, sorted by revision.
+func readBackup(data []byte) (map[string][]*release.Release, error) {
+	gr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	tr := tar.NewReader(gr)
+
+	releases := map[string][]*release.Release{}
+	var size int64
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if header.Typeflag != tar.TypeReg || !backupReleaseFile.MatchString(path.Clean(header.Name)) {
+			continue
+		}
+		size += header.Size
+		if size > maxBackupSize {
+			return nil, fmt.Errorf("backup exceeds %d bytes", maxBackupSize)
+		}
+
+		var rls release.Release
+		err = json.NewDecoder(io.LimitReader(tr, header.Size)).Decode(&rls)
+		if err != nil {
+			return nil, fmt.Errorf("failed parsing %s: %s", header.Name, err)
+		}
+		if rls.Name == "" || rls.Version <= 0 || rls.Info == nil {
+			return nil, fmt.Errorf("invalid release record %s", header.Name)
+		}
+		releases[rls.Name] = append(releases[rls.Name], &rls)
+	}
+	for _, revisions := range releases {
+		sort.Slice(revisions, func(i, j int) bool {
+			return revisions[i].Version < revisions[j].Version
+		})
+	}
+
+	return releases, nil
+}
+
+func respBackup(c *gin.Context, filename, namespace string, releases []*release.Release) {
+	var buf bytes.Buffer
+	if err := writeBackup(&buf, namespace, releases); err != nil {
+		respErr(c, err)
+		return
+	}
+
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	c.Data(http.StatusOK, "application/gzip", buf.Bytes())
+}
+
+// backupRelease exports all revisions of a release.
+func backupRelease(c *gin.Context) {
+	name := c.Param("release")
+	namespace := c.Param("namespace")
+
+	actionConfig, err := actionConfigInit(kubeInformation(c, namespace))
+	if err != nil {
+		respErr(c, err)
+		return
+	}
+	releases, err := actionConfig.Releases.History(name)
+	if err != nil {
+		respErr(c, err)
+		return
+	}
+
+	respBackup(c, fmt.Sprintf("%s-%s.tgz", namespace, name), namespace, releases)
+}
+
+// backupNamespace exports all revisions of all releases of a namespace.
+func backupNamespace(c *gin.Context) {
+	namespace := c.Param("namespace")
+
+	actionConfig, err := actionConfigInit(kubeInformation(c, namespace))
+	if err != nil {
+		respErr(c, err)
+		return
+	}
+	releases, err := actionConfig.Releases.ListReleases()
+	if err != nil {
+		respErr(c, err)
+		return
+	}
+
+	respBackup(c, namespace+".tgz", namespace, releases)
+}
+
+// lastDeployed returns the last deployed revision of a release, if any.
+func lastDeployed(revisions []*release.Release) *release.Release {
+	var deployed *release.Release
+	for _, rls := range revisions {
+		if rls.Info.Status == release.StatusDeployed {
+			deployed = rls
+		}
+	}
+
+	return deployed
+}
+
+// reapplyRelease applies the manifest of the last deployed revision, missing
+// objects are created and changed ones patched.
+func reapplyRelease(actionConfig *action.Configuration, revisions []*release.Release) (bool, error) {
+	deployed := lastDeployed(revisions)
+	if deployed == nil {
+		return false, nil
+	}
+
+	resources, err := actionConfig.KubeClient.Build(strings.NewReader(deployed.Manifest), false)
+	if err != nil {
+		return false, err
+	}
+	if _, err := actionConfig.KubeClient.Update(resources, resources, false); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// restoreBackup writes the release records of a backup into the namespace
+// of actionConfig. Existing releases are refused before anything is written,
+// with force their history is deleted first, so no revision of it remains
+// next to the restored ones. The releases restored until a failure are
+// returned with the error.
+func restoreBackup(actionConfig *action.Configuration, namespace string, releases map[string][]*release.Release, force, reapply bool) ([]*restoredRelease, error) {
+	names := make([]string, 0, len(releases))
+	for name := range releases {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// check everything before writing anything
+	existing := map[string][]*release.Release{}
+	for _, name := range names {
+		history, err := actionConfig.Releases.History(name)
+		if err != nil && !errors.Is(err, driver.ErrReleaseNotFound) {
+			return nil, err
+		}
+		if len(history) > 0 && !force {
+			return nil, fmt.Errorf("release %s exists in namespace %s, restore with force=true to overwrite it", name, namespace)
+		}
+		existing[name] = history
+		for _, rls := range releases[name] {
+			rls.Namespace = namespace
+		}
+		if deployed := lastDeployed(releases[name]); reapply && deployed != nil {
+			if _, err := actionConfig.KubeClient.Build(strings.NewReader(deployed.Manifest), false); err != nil {
+				return nil, fmt.Errorf("failed to build the manifest of %s revision %d: %s", name, deployed.Version, err)
+			}
+		}
+	}
+
+	restored := make([]*restoredRelease, 0, len(names))
+	for _, name := range names {
+		result := &restoredRelease{Release: name, Revisions: []int{}}
+		restored = append(restored, result)
+		for _, rls := range existing[name] {
+			if _, err := actionConfig.Releases.Delete(name, rls.Version); err != nil {
+				return restored, fmt.Errorf("failed to delete %s revision %d: %s", name, rls.Version, err)
+			}
+		}
+		for _, rls := range releases[name] {
+			if err := actionConfig.Releases.Create(rls); err != nil {
+				return restored, fmt.Errorf("failed to restore %s revision %d: %s", name, rls.Version, err)
+			}
+			result.Revisions = append(result.Revisions, rls.Version)
+		}
+		if reapply {
+			var err error
+			result.Reapplied, err = reapplyRelease(actionConfig, releases[name])
+			if err != nil {
+				return restored, fmt.Errorf("failed to reapply %s: %s", name, err)
+			}
+		}
+	}
+
+	return restored, nil
+}
+
+// restoreReleases writes the release records of a backup into a namespace,
+// optionally of one release only. Existing releases are only replaced with
+// force.
+func restoreReleases(c *gin.Context) {
+	namespace := c.Param("namespace")
+	only := c.Query("release")
+	force := c.Query("force") == "true"
+	reapply := c.Query("reapply") == "true"
+
+	data, err := readFormFile(c, "backup")
+	if err != nil {
+		respErr(c, err)
+		return
+	}
+	releases, err := readBackup(data)
+	if err != nil {
+		respErr(c, fmt.Errorf("failed to read backup: %s", err))
+		return
+	}
+	if only != "" {
+		if _, ok := releases[only]; !ok {
+			respErr(c, fmt.Errorf("release %s is not in the backup", only))
+			return
+		}
+		releases = map[string][]*release.Release{only: releases[only]}
+	}
+	if len(releases) == 0 {
+		respErr(c, fmt.Errorf("backup has no releases"))
+		return
+	}
+
+	actionConfig, err := actionConfigInit(kubeInformation(c, namespace))
+	if err != nil {
+		respErr(c, err)
+		return
+	}
+	restored, err := restoreBackup(actionConfig, namespace, releases, force, reapply)
+	if err != nil {
+		if restored != nil {
+			respErrWithData(c, err, restored)
+			return
+		}
+		respErr(c, err)
+		return
+	}
+
+	respOK(c, restored)
+}
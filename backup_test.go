@@ -0,0 +1,138 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/chart"
+	kubefake "helm.sh/helm/v3/pkg/kube/fake"
+	"helm.sh/helm/v3/pkg/release"
+	"helm.sh/helm/v3/pkg/storage"
+	"helm.sh/helm/v3/pkg/storage/driver"
+)
+
+func newTestRelease(name string, version int, status release.Status) *release.Release {
+	return &release.Release{
+		Name:      name,
+		Namespace: "backup",
+		Version:   version,
+		Info:      &release.Info{Status: status},
+		Chart:     &chart.Chart{Metadata: &chart.Metadata{Name: name, Version: "0.1.0"}},
+	}
+}
+
+func newRestoreActionConfig(t *testing.T, existing ...*release.Release) *action.Configuration {
+	t.Helper()
+
+	mem := driver.NewMemory()
+	mem.SetNamespace("restore")
+	actionConfig := &action.Configuration{
+		Releases:   storage.Init(mem),
+		KubeClient: &kubefake.FailingKubeClient{PrintingKubeClient: kubefake.PrintingKubeClient{Out: io.Discard}},
+	}
+	for _, rls := range existing {
+		rls.Namespace = "restore"
+		if err := actionConfig.Releases.Create(rls); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return actionConfig
+}
+
+// storedRevisions returns the revisions and statuses of a release.
+func storedRevisions(t *testing.T, actionConfig *action.Configuration, name string) map[int]release.Status {
+	t.Helper()
+
+	history, err := actionConfig.Releases.History(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	revisions := map[int]release.Status{}
+	for _, rls := range history {
+		revisions[rls.Version] = rls.Info.Status
+	}
+
+	return revisions
+}
+
+func TestRestoreBackup(t *testing.T) {
+	backup := func() map[string][]*release.Release {
+		return map[string][]*release.Release{
+			"db": {
+				newTestRelease("db", 1, release.StatusSuperseded),
+				newTestRelease("db", 2, release.StatusDeployed),
+			},
+			"web": {
+				newTestRelease("web", 1, release.StatusDeployed),
+			},
+		}
+	}
+
+	t.Run("existing release without force", func(t *testing.T) {
+		actionConfig := newRestoreActionConfig(t, newTestRelease("web", 1, release.StatusDeployed))
+		restored, err := restoreBackup(actionConfig, "restore", backup(), false, false)
+		if err == nil || !strings.Contains(err.Error(), "force=true") {
+			t.Fatalf("got error %v, want a refusal", err)
+		}
+		if restored != nil {
+			t.Errorf("got restored %v, want nothing restored", restored)
+		}
+		if _, err := actionConfig.Releases.History("db"); !errors.Is(err, driver.ErrReleaseNotFound) {
+			t.Errorf("db was restored before the refusal")
+		}
+	})
+
+	t.Run("force replaces the history", func(t *testing.T) {
+		actionConfig := newRestoreActionConfig(t,
+			newTestRelease("db", 1, release.StatusSuperseded),
+			newTestRelease("db", 2, release.StatusSuperseded),
+			newTestRelease("db", 3, release.StatusDeployed),
+		)
+		restored, err := restoreBackup(actionConfig, "restore", backup(), true, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []*restoredRelease{
+			{Release: "db", Revisions: []int{1, 2}},
+			{Release: "web", Revisions: []int{1}},
+		}
+		if !reflect.DeepEqual(restored, want) {
+			t.Errorf("got restored %+v, want %+v", restored, want)
+		}
+		got := storedRevisions(t, actionConfig, "db")
+		wantDB := map[int]release.Status{1: release.StatusSuperseded, 2: release.StatusDeployed}
+		if !reflect.DeepEqual(got, wantDB) {
+			t.Errorf("got revisions of db %v, want %v", got, wantDB)
+		}
+	})
+
+	t.Run("failed reapply returns the partial restore", func(t *testing.T) {
+		actionConfig := newRestoreActionConfig(t)
+		actionConfig.KubeClient.(*kubefake.FailingKubeClient).UpdateError = errors.New("forbidden")
+		restored, err := restoreBackup(actionConfig, "restore", backup(), false, true)
+		if err == nil || !strings.Contains(err.Error(), "failed to reapply db") {
+			t.Fatalf("got error %v, want the reapply of db to fail", err)
+		}
+		want := []*restoredRelease{{Release: "db", Revisions: []int{1, 2}}}
+		if !reflect.DeepEqual(restored, want) {
+			t.Errorf("got restored %+v, want %+v", restored, want)
+		}
+	})
+
+	t.Run("invalid manifest is refused before writing", func(t *testing.T) {
+		actionConfig := newRestoreActionConfig(t)
+		actionConfig.KubeClient.(*kubefake.FailingKubeClient).BuildError = errors.New("invalid manifest")
+		restored, err := restoreBackup(actionConfig, "restore", backup(), false, true)
+		if err == nil || restored != nil {
+			t.Fatalf("got restored %v error %v, want a refusal", restored, err)
+		}
+		if _, err := actionConfig.Releases.History("db"); !errors.Is(err, driver.ErrReleaseNotFound) {
+			t.Errorf("db was restored before the refusal")
+		}
+	})
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"helm.sh/helm/v3/pkg/chart"
+)
+
+const (
+	changeAdded   = "added"
+	changeRemoved = "removed"
+	changeChanged = "changed"
+)
+
+type chartChange struct {
+	Path string      `json:"path"`
+	Type string      `json:"type"` // added, removed or changed
+	From interface{} `json:"from,omitempty"`
+	To   interface{} `json:"to,omitempty"`
+}
+
+type chartFileChanges struct {
+	Added   []string `json:"added"`
+	Removed []string `json:"removed"`
+	Changed []string `json:"changed"`
+}
+
+type chartDiff struct {
+	Chart        string           `json:"chart"`
+	From         string           `json:"from"`
+	To           string           `json:"to"`
+	Metadata     []chartChange    `json:"metadata"`
+	Dependencies []chartChange    `json:"dependencies"`
+	Values       []chartChange    `json:"values"`
+	Templates    chartFileChanges `json:"templates"`
+	CRDs         chartFileChanges `json:"crds"`
+}
+
+// diffMaps compares two flattened maps, sorted by key.
+func diffMaps(from, to map[string]interface{}) []chartChange {
+	keys := map[string]bool{}
+	for k := range from {
+		keys[k] = true
+	}
+	for k := range to {
+		keys[k] = true
+	}
+	sorted := make([]string, 0, len(keys))
+	for k := range keys {
+		sorted = append(sorted, k)
+	}
+	sort.Strings(sorted)
+
+	changes := []chartChange{}
+	for _, k := range sorted {
+		f, inFrom := from[k]
+		t, inTo := to[k]
+		switch {
+		case !inFrom:
+			changes = append(changes, chartChange{Path: k, Type: changeAdded, To: t})
+		case !inTo:
+			changes = append(changes, chartChange{Path: k, Type: changeRemoved, From: f})
+		case !reflect.DeepEqual(f, t):
+			changes = append(changes, chartChange{Path: k, Type: changeChanged, From: f, To: t})
+		}
+	}
+
+	return changes
+}
+
+// flattenValues flattens nested values to dotted paths, lists and empty maps
+// are kept as leaves.
+func flattenValues(prefix string, values map[string]interface{}, out map[string]interface{}) map[string]interface{} {
+	for k, v := range values {
+		path := k
+		if prefix != "" {
+			path = prefix + "." + k
+		}
+		if m, ok := v.(map[string]interface{}); ok && len(m) > 0 {
+			flattenValues(path, m, out)
+			continue
+		}
+		out[path] = v
+	}
+
+	return out
+}
+
+func chartMetadataFields(md *chart.Metadata) map[string]interface{} {
+	fields := map[string]interface{}{
+		"version":     md.Version,
+		"appVersion":  md.AppVersion,
+		"kubeVersion": md.KubeVersion,
+		"apiVersion":  md.APIVersion,
+		"type":        md.Type,
+		"deprecated":  md.Deprecated,
+	}
+	for k, v := range fields {
+		if v == "" {
+			delete(fields, k)
+		}
+	}
+
+	return fields
+}
+
+// chartDependencyFields flattens the dependencies of Chart.yaml, keyed by
+// their alias or name.
+func chartDependencyFields(md *chart.Metadata) map[string]interface{} {
+	fields := map[string]interface{}{}
+	for _, dep := range md.Dependencies {
+		name := dep.Name
+		if dep.Alias != "" {
+			name = dep.Alias
+		}
+		fields[name+".version"] = dep.Version
+		fields[name+".repository"] = dep.Repository
+		if dep.Condition != "" {
+			fields[name+".condition"] = dep.Condition
+		}
+		if len(dep.Tags) > 0 {
+			fields[name+".tags"] = dep.Tags
+		}
+	}
+
+	return fields
+}
+
+func diffChartFiles(from, to []*chart.File) chartFileChanges {
+	changes := chartFileChanges{Added: []string{}, Removed: []string{}, Changed: []string{}}
+	fromFiles := map[string][]byte{}
+	for _, f := range from {
+		fromFiles[f.Name] = f.Data
+	}
+	toFiles := map[string]bool{}
+	for _, f := range to {
+		toFiles[f.Name] = true
+		data, ok := fromFiles[f.Name]
+		if !ok {
+			changes.Added = append(changes.Added, f.Name)
+		} else if !bytes.Equal(data, f.Data) {
+			changes.Changed = append(changes.Changed, f.Name)
+		}
+	}
+	for _, f := range from {
+		if !toFiles[f.Name] {
+			changes.Removed = append(changes.Removed, f.Name)
+		}
+	}
+	sort.Strings(changes.Added)
+	sort.Strings(changes.Removed)
+	sort.Strings(changes.Changed)
+
+	return changes
+}
+
+func chartCRDFiles(chrt *chart.Chart) []*chart.File {
+	var files []*chart.File
+	for _, f := range chrt.Files {
+		if strings.HasPrefix(f.Name, "crds/") {
+			files = append(files, f)
+		}
+	}
+
+	return files
+}
+
+func diffCharts(from, to *chart.Chart) *chartDiff {
+	return &chartDiff{
+		Chart:        to.Name(),
+		From:         from.Metadata.Version,
+		To:           to.Metadata.Version,
+		Metadata:     diffMaps(chartMetadataFields(from.Metadata), chartMetadataFields(to.Metadata)),
+		Dependencies: diffMaps(chartDependencyFields(from.Metadata), chartDependencyFields(to.Metadata)),
+		Values:       diffMaps(flattenValues("", from.Values, map[string]interface{}{}), flattenValues("", to.Values, map[string]interface{}{})),
+		Templates:    diffChartFiles(from.Templates, to.Templates),
+		CRDs:         diffChartFiles(chartCRDFiles(from), chartCRDFiles(to)),
+	}
+}
+
+// chartVersionRef returns the reference of a chart version for loadChart,
+// plain chart names refer to uploaded charts.
+func chartVersionRef(name, version string) string {
+	if strings.ContainsAny(name, "/:@") {
+		return name
+	}
+
+	return name + "@" + version
+}
+
+func compareChartVersions(c *gin.Context) {
+	name := c.Query("chart")
+	from := c.Query("from")
+	to := c.Query("to")
+	if name == "" {
+		respErr(c, fmt.Errorf("chart name can not be empty"))
+		return
+	}
+	if from == "" || to == "" {
+		respErr(c, fmt.Errorf("from and to versions can not be empty"))
+		return
+	}
+
+	fromChart, err := loadChart(chartVersionRef(name, from), from)
+	if err != nil {
+		respErr(c, err)
+		return
+	}
+	toChart, err := loadChart(chartVersionRef(name, to), to)
+	if err != nil {
+		respErr(c, err)
+		return
+	}
+
+	respOK(c, diffCharts(fromChart, toChart))
+}
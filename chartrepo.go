@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang/glog"
+	"helm.sh/helm/v3/pkg/chart/loader"
+	"helm.sh/helm/v3/pkg/repo"
+	"sigs.k8s.io/yaml"
+)
+
+// chartRepoBaseURL is the path, relative to the repository root, under which
+// chart archives are served. It matches the ChartMuseum layout.
+const chartRepoBaseURL = "charts"
+
+// chartRepoIndexTTL bounds how long the index is served without looking at
+// the chart storage, which may be shared by several replicas.
+const chartRepoIndexTTL = time.Minute
+
+// chartRepoIndex caches the index.yaml generated from the chart storage.
+type chartRepoIndex struct {
+	sync.RWMutex
+	index   *repo.IndexFile
+	data    []byte
+	updated time.Time
+}
+
+var uploadRepoIndex = &chartRepoIndex{}
+
+// rebuild regenerates the index from the metadata of the uploaded charts.
+func (i *chartRepoIndex) rebuild() error {
+	charts, err := listUploadedChartVersions()
+	if err != nil {
+		return err
+	}
+
+	index := repo.NewIndexFile()
+	for _, c := range charts {
+		for _, v := range c.Versions {
+			md := v.Metadata
+			if md == nil {
+				// metadata stored before the Chart.yaml was kept
+				data, err := chartStore.Get(uploadedChartKey(v.Name, v.Version))
+				if err != nil {
+					return err
+				}
+				chrt, err := loader.LoadArchive(bytes.NewReader(data))
+				if err != nil {
+					glog.Warningf("skip indexing chart %s@%s: %s", v.Name, v.Version, err)
+					continue
+				}
+				md = chrt.Metadata
+			}
+			filename := path.Base(uploadedChartKey(v.Name, v.Version))
+			err := index.MustAdd(md, filename, chartRepoBaseURL+"/"+v.Name, v.Digest)
+			if err != nil {
+				glog.Warningf("skip indexing chart %s@%s: %s", v.Name, v.Version, err)
+				continue
+			}
+			cv, _ := index.Get(v.Name, v.Version)
+			cv.Created = v.Created
+		}
+	}
+	index.SortEntries()
+
+	data, err := yaml.Marshal(index)
+	if err != nil {
+		return err
+	}
+
+	i.Lock()
+	defer i.Unlock()
+	i.index = index
+	i.data = data
+	i.updated = time.Now()
+
+	return nil
+}
+
+func (i *chartRepoIndex) expired() bool {
+	i.RLock()
+	defer i.RUnlock()
+
+	return time.Since(i.updated) > chartRepoIndexTTL
+}
+
+func (i *chartRepoIndex) get(name, version string) (*repo.ChartVersion, bool) {
+	if i.expired() {
+		refreshChartRepoIndex()
+	}
+
+	i.RLock()
+	defer i.RUnlock()
+	if i.index == nil {
+		return nil, false
+	}
+	cv, err := i.index.Get(name, version)
+	if err != nil {
+		return nil, false
+	}
+
+	return cv, true
+}
+
+// refreshChartRepoIndex rebuilds the index after the chart storage changed.
+// Failures are logged only, the previous index is kept.
+func refreshChartRepoIndex() {
+	if err := uploadRepoIndex.rebuild(); err != nil {
+		glog.Warningf("failed to rebuild chart repository index: %s", err)
+	}
+}
+
+func cmRespErr(c *gin.Context, code int, err error) {
+	glog.Warningln(err)
+
+	c.JSON(code, gin.H{"error": err.Error()})
+}
+
+func getChartRepoIndex(c *gin.Context) {
+	if uploadRepoIndex.expired() {
+		refreshChartRepoIndex()
+	}
+
+	uploadRepoIndex.RLock()
+	data := uploadRepoIndex.data
+	uploadRepoIndex.RUnlock()
+
+	c.Data(http.StatusOK, "application/x-yaml", data)
+}
+
+func downloadRepoChart(c *gin.Context) {
+	name := c.Param("name")
+	filename := c.Param("file")
+	if !isPathElement(name) || !isPathElement(filename) ||
+		(!strings.HasSuffix(filename, ".tgz") && !strings.HasSuffix(filename, ".tgz.prov")) {
+		c.Status(http.StatusNotFound)
+		return
+	}
+
+	data, err := chartStore.Get(name + "/" + filename)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			c.Status(http.StatusNotFound)
+			return
+		}
+		cmRespErr(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	c.Data(http.StatusOK, "application/octet-stream", data)
+}
+
+// postRepoChart stores a chart the way ChartMuseum's POST /api/charts does,
+// either from the raw request body or from the "chart" and "prov" fields
+// of a multipart form.
+func postRepoChart(c *gin.Context) {
+	var (
+		chartData []byte
+		provData  []byte
+		err       error
+	)
+	if strings.HasPrefix(c.ContentType(), "multipart/") {
+		chartData, err = readFormFile(c, "chart")
+		if err != nil {
+			cmRespErr(c, http.StatusBadRequest, err)
+			return
+		}
+		provData, err = readFormFile(c, "prov")
+		if err != nil && err != http.ErrMissingFile {
+			cmRespErr(c, http.StatusBadRequest, err)
+			return
+		}
+	} else {
+		chartData, err = io.ReadAll(c.Request.Body)
+		if err != nil {
+			cmRespErr(c, http.StatusBadRequest, err)
+			return
+		}
+	}
+	if len(chartData) == 0 {
+		cmRespErr(c, http.StatusBadRequest, fmt.Errorf("no chart content"))
+		return
+	}
+
+	_, err = saveUploadedChart(chartData, provData, chartUploadOptionsFromRequest(c))
+	if err != nil {
+		if errors.Is(err, errChartVersionExists) {
+			cmRespErr(c, http.StatusConflict, err)
+			return
+		}
+		cmRespErr(c, http.StatusBadRequest, err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"saved": true})
+}
+
+// deleteRepoChart removes a chart version the way ChartMuseum's
+// DELETE /api/charts/:name/:version does.
+func deleteRepoChart(c *gin.Context) {
+	name := c.Param("name")
+	version := c.Param("version")
+
+	if _, ok := uploadRepoIndex.get(name, version); !ok {
+		cmRespErr(c, http.StatusNotFound, fmt.Errorf("chart %s-%s not found", name, version))
+		return
+	}
+
+	err := removeUploadedChart(name, version)
+	if err != nil {
+		cmRespErr(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"deleted": true})
+}
+
+func readFormFile(c *gin.Context, field string) ([]byte, error) {
+	file, _, err := c.Request.FormFile(field)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return io.ReadAll(file)
+}
@@ -13,11 +13,33 @@ import (
 
 var readmeFileNames = []string{"readme.md", "readme.txt", "readme"}
 
+const chartInfoDetails = "details"
+
 type file struct {
 	Name string `json:"name"`
 	Data string `json:"data"`
 }
 
+type chartDependencyNode struct {
+	Name         string                 `json:"name"`
+	Alias        string                 `json:"alias,omitempty"`
+	Version      string                 `json:"version,omitempty"`  // version constraint of Chart.yaml
+	Resolved     string                 `json:"resolved,omitempty"` // version of the bundled subchart
+	Repository   string                 `json:"repository,omitempty"`
+	Condition    string                 `json:"condition,omitempty"`
+	Tags         []string               `json:"tags,omitempty"`
+	Dependencies []*chartDependencyNode `json:"dependencies"`
+}
+
+type chartDetails struct {
+	Metadata     *chart.Metadata        `json:"metadata"`
+	Dependencies []*chartDependencyNode `json:"dependencies"`
+	CRDs         []string               `json:"crds"`
+	Templates    []string               `json:"templates"`
+	HasSchema    bool                   `json:"has_schema"`
+	Readme       string                 `json:"readme"`
+}
+
 func findReadme(files []*chart.File) (file *chart.File) {
 	for _, file := range files {
 		for _, n := range readmeFileNames {
@@ -29,6 +51,118 @@ func findReadme(files []*chart.File) (file *chart.File) {
 	return nil
 }
 
+// chartDependencyTree returns the dependencies of Chart.yaml together with
+// the subcharts bundled in charts/, recursively.
+func chartDependencyTree(chrt *chart.Chart) []*chartDependencyNode {
+	subcharts := map[string]*chart.Chart{}
+	for _, sub := range chrt.Dependencies() {
+		subcharts[sub.Name()] = sub
+	}
+	locked := map[string]string{}
+	if chrt.Lock != nil {
+		for _, dep := range chrt.Lock.Dependencies {
+			locked[dep.Name] = dep.Version
+		}
+	}
+
+	nodes := []*chartDependencyNode{}
+	for _, dep := range chrt.Metadata.Dependencies {
+		node := &chartDependencyNode{
+			Name:         dep.Name,
+			Alias:        dep.Alias,
+			Version:      dep.Version,
+			Resolved:     locked[dep.Name],
+			Repository:   dep.Repository,
+			Condition:    dep.Condition,
+			Tags:         dep.Tags,
+			Dependencies: []*chartDependencyNode{},
+		}
+		if sub, ok := subcharts[dep.Name]; ok {
+			node.Resolved = sub.Metadata.Version
+			node.Dependencies = chartDependencyTree(sub)
+			delete(subcharts, dep.Name)
+		}
+		nodes = append(nodes, node)
+	}
+	// subcharts which are not declared in Chart.yaml
+	for _, sub := range chrt.Dependencies() {
+		if _, ok := subcharts[sub.Name()]; !ok {
+			continue
+		}
+		nodes = append(nodes, &chartDependencyNode{
+			Name:         sub.Name(),
+			Resolved:     sub.Metadata.Version,
+			Dependencies: chartDependencyTree(sub),
+		})
+	}
+
+	return nodes
+}
+
+func getChartDetails(chrt *chart.Chart) *chartDetails {
+	details := &chartDetails{
+		Metadata:     chrt.Metadata,
+		Dependencies: chartDependencyTree(chrt),
+		CRDs:         []string{},
+		Templates:    []string{},
+		HasSchema:    len(chrt.Schema) > 0,
+	}
+	// CRDs of the subcharts are installed as well, so they are listed with
+	// their full path
+	for _, crd := range chrt.CRDObjects() {
+		details.CRDs = append(details.CRDs, crd.Filename)
+	}
+	for _, f := range chrt.Templates {
+		details.Templates = append(details.Templates, f.Name)
+	}
+	if readme := findReadme(chrt.Files); readme != nil {
+		details.Readme = string(readme.Data)
+	}
+
+	return details
+}
+
+// loadChart loads an uploaded chart (<name>@<version>), or locates and loads
+// a chart of a repository, an OCI registry or a URL.
+func loadChart(name, version string) (*chart.Chart, error) {
+	return loadChartWithOptions(name, ChartPathOptions{Version: version})
+}
+
+// loadChartWithOptions loads a chart with the repository and credentials of
+// a release.
+func loadChartWithOptions(name string, options ChartPathOptions) (*chart.Chart, error) {
+	name, err := resolveUploadedChart(name)
+	if err != nil {
+		return nil, err
+	}
+
+	client := action.NewShow(action.ShowAll)
+	client.ChartPathOptions.CaFile = options.CaFile
+	client.ChartPathOptions.CertFile = options.CertFile
+	client.ChartPathOptions.KeyFile = options.KeyFile
+	client.ChartPathOptions.InsecureSkipTLSverify = options.InsecureSkipTLSverify
+	client.ChartPathOptions.Password = options.Password
+	client.ChartPathOptions.RepoURL = options.RepoURL
+	client.ChartPathOptions.Username = options.Username
+	client.ChartPathOptions.Version = options.Version
+	client.ChartPathOptions.Verify = options.Verify
+	client.ChartPathOptions.Keyring = options.Keyring
+	registryClient, err := createOCIRegistryClientForChartPathOptions(&name, &client.ChartPathOptions)
+	if err != nil {
+		return nil, err
+	}
+	if registryClient != nil {
+		client.SetRegistryClient(registryClient)
+	}
+
+	cp, err := client.ChartPathOptions.LocateChart(name, settings)
+	if err != nil {
+		return nil, err
+	}
+
+	return loader.Load(cp)
+}
+
 func showChartInfo(c *gin.Context) {
 	name := c.Query("chart")
 	if name == "" {
@@ -36,13 +170,7 @@ func showChartInfo(c *gin.Context) {
 		return
 	}
 
-	// local charts with abs path *.tgz
-	splitChart := strings.Split(name, ".")
-	if splitChart[len(splitChart)-1] == "tgz" && !strings.Contains(name, ":") {
-		name = helmConfig.UploadPath + "/" + name
-	}
-
-	info := c.Query("info") // all, readme, values, chart
+	info := c.Query("info") // all, readme, values, chart, details
 	if info == "" {
 		info = string(action.ShowAll)
 	}
@@ -58,23 +186,21 @@ func showChartInfo(c *gin.Context) {
 		client.OutputFormat = action.ShowValues
 	} else if info == string(action.ShowAll) {
 		client.OutputFormat = action.ShowAll
-	} else {
-		respErr(c, fmt.Errorf("bad info %s, chart info only support readme/values/chart", info))
+	} else if info != chartInfoDetails {
+		respErr(c, fmt.Errorf("bad info %s, chart info only support readme/values/chart/details", info))
 		return
 	}
 
-	cp, err := client.ChartPathOptions.LocateChart(name, settings)
+	chrt, err := loadChart(name, version)
 	if err != nil {
 		respErr(c, err)
 		return
 	}
 
-	chrt, err := loader.Load(cp)
-	if err != nil {
-		respErr(c, err)
+	if info == chartInfoDetails {
+		respOK(c, getChartDetails(chrt))
 		return
 	}
-
 	if client.OutputFormat == action.ShowChart {
 		respOK(c, chrt.Metadata)
 		return
@@ -91,7 +217,11 @@ func showChartInfo(c *gin.Context) {
 		return
 	}
 	if client.OutputFormat == action.ShowReadme {
-		respOK(c, string(findReadme(chrt.Files).Data))
+		var readme string
+		if f := findReadme(chrt.Files); f != nil {
+			readme = string(f.Data)
+		}
+		respOK(c, readme)
 		return
 	}
 	if client.OutputFormat == action.ShowAll {
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/chart/loader"
+	"helm.sh/helm/v3/pkg/chartutil"
+	"helm.sh/helm/v3/pkg/downloader"
+	"helm.sh/helm/v3/pkg/getter"
+)
+
+// maxChartSourceSize bounds the extracted size of an uploaded chart source.
+const maxChartSourceSize = 100 << 20
+
+// extractChartSource unpacks a tar, tar.gz or zip archive of an unpackaged
+// chart directory into dir.
+func extractChartSource(data []byte, dir string) error {
+	if bytes.HasPrefix(data, []byte("PK\x03\x04")) {
+		return extractZip(data, dir)
+	}
+
+	var r io.Reader = bytes.NewReader(data)
+	if bytes.HasPrefix(data, []byte{0x1f, 0x8b}) {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	return extractTar(r, dir)
+}
+
+// sourceFilePath joins an archive entry name to dir, refusing entries that
+// would escape it.
+func sourceFilePath(dir, name string) (string, error) {
+	p := filepath.Join(dir, filepath.FromSlash(name))
+	if p != filepath.Clean(dir) && !strings.HasPrefix(p, filepath.Clean(dir)+string(os.PathSeparator)) {
+		return "", fmt.Errorf("illegal file path %s in chart source", name)
+	}
+
+	return p, nil
+}
+
+func writeSourceFile(p string, r io.Reader, written *int64) error {
+	err := os.MkdirAll(filepath.Dir(p), 0755)
+	if err != nil {
+		return err
+	}
+	f, err := os.Create(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	n, err := io.Copy(f, io.LimitReader(r, maxChartSourceSize-*written+1))
+	*written += n
+	if err != nil {
+		return err
+	}
+	if *written > maxChartSourceSize {
+		return fmt.Errorf("chart source exceeds %d bytes", maxChartSourceSize)
+	}
+
+	return nil
+}
+
+func extractTar(r io.Reader, dir string) error {
+	var written int64
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		p, err := sourceFilePath(dir, header.Name)
+		if err != nil {
+			return err
+		}
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(p, 0755)
+		case tar.TypeReg:
+			err = writeSourceFile(p, tr, &written)
+		default:
+			// links and special files are not part of a chart
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func extractZip(data []byte, dir string) error {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return err
+	}
+
+	var written int64
+	for _, f := range zr.File {
+		p, err := sourceFilePath(dir, f.Name)
+		if err != nil {
+			return err
+		}
+		if f.FileInfo().IsDir() {
+			err = os.MkdirAll(p, 0755)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if !f.Mode().IsRegular() {
+			continue
+		}
+
+		rc, err := f.Open()
+		if err != nil {
+			return err
+		}
+		err = writeSourceFile(p, rc, &written)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// findChartDir returns the directory holding Chart.yaml, either dir itself
+// or its single top level directory.
+func findChartDir(dir string) (string, error) {
+	if _, err := os.Stat(filepath.Join(dir, chartutil.ChartfileName)); err == nil {
+		return dir, nil
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return "", err
+	}
+	if len(entries) == 1 && entries[0].IsDir() {
+		chartDir := filepath.Join(dir, entries[0].Name())
+		if _, err := os.Stat(filepath.Join(chartDir, chartutil.ChartfileName)); err == nil {
+			return chartDir, nil
+		}
+	}
+
+	return "", fmt.Errorf("no %s found in chart source", chartutil.ChartfileName)
+}
+
+// packageChartSource builds the dependencies of an unpackaged chart from
+// the configured repositories and packages it.
+func packageChartSource(chartDir, outDir string) ([]byte, error) {
+	chrt, err := loader.LoadDir(chartDir)
+	if err != nil {
+		return nil, fmt.Errorf("invalid chart source: %s", err)
+	}
+
+	if req := chrt.Metadata.Dependencies; req != nil {
+		if err := action.CheckDependencies(chrt, req); err != nil {
+			registryClient, err := ociRegistries.dependencyClient(req)
+			if err != nil {
+				return nil, err
+			}
+			man := &downloader.Manager{
+				Out:              io.Discard,
+				ChartPath:        chartDir,
+				Getters:          getter.All(settings),
+				RegistryClient:   registryClient,
+				RepositoryConfig: settings.RepositoryConfig,
+				RepositoryCache:  settings.RepositoryCache,
+			}
+			if err := man.Build(); err != nil {
+				return nil, fmt.Errorf("failed to build chart dependencies: %s", err)
+			}
+
+			chrt, err = loader.LoadDir(chartDir)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	archive, err := chartutil.Save(chrt, outDir)
+	if err != nil {
+		return nil, err
+	}
+
+	return os.ReadFile(archive)
+}
+
+func uploadChartSource(c *gin.Context) {
+	data, err := readFormFile(c, "source")
+	if err != nil {
+		respErr(c, err)
+		return
+	}
+
+	tmpDir, err := os.MkdirTemp("", "helm-wrapper-source-")
+	if err != nil {
+		respErr(c, err)
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	srcDir := filepath.Join(tmpDir, "src")
+	err = extractChartSource(data, srcDir)
+	if err != nil {
+		respErr(c, fmt.Errorf("failed to extract chart source: %s", err))
+		return
+	}
+	chartDir, err := findChartDir(srcDir)
+	if err != nil {
+		respErr(c, err)
+		return
+	}
+	chartData, err := packageChartSource(chartDir, tmpDir)
+	if err != nil {
+		respErr(c, err)
+		return
+	}
+
+	opts := chartUploadOptionsFromRequest(c)
+	opts.Sign = c.Query("sign") == "true" || c.PostForm("sign") == "true"
+	meta, err := saveUploadedChart(chartData, nil, opts)
+	if err != nil {
+		respUploadErr(c, err)
+		return
+	}
+
+	respOK(c, meta)
+}
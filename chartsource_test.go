@@ -0,0 +1,212 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type testSourceEntry struct {
+	name string
+	body string
+	size int64  // of a file of zeros instead of body
+	link string // target of a symlink
+}
+
+func (e testSourceEntry) reader() io.Reader {
+	if e.size > 0 {
+		return io.LimitReader(zeroReader{}, e.size)
+	}
+	return strings.NewReader(e.body)
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+func newTestTar(t *testing.T, entries []testSourceEntry, compress bool) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	var w io.Writer = &buf
+	var gw *gzip.Writer
+	if compress {
+		gw = gzip.NewWriter(&buf)
+		w = gw
+	}
+	tw := tar.NewWriter(w)
+	for _, e := range entries {
+		header := &tar.Header{Name: e.name, Mode: 0644, Typeflag: tar.TypeReg, Size: int64(len(e.body))}
+		if e.size > 0 {
+			header.Size = e.size
+		}
+		if e.link != "" {
+			header = &tar.Header{Name: e.name, Mode: 0777, Typeflag: tar.TypeSymlink, Linkname: e.link}
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if e.link == "" {
+			if _, err := io.Copy(tw, e.reader()); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if gw != nil {
+		if err := gw.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return buf.Bytes()
+}
+
+func newTestZip(t *testing.T, entries []testSourceEntry) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, e := range entries {
+		header := &zip.FileHeader{Name: e.name, Method: zip.Deflate}
+		header.SetMode(0644)
+		body := e.reader()
+		if e.link != "" {
+			header.SetMode(os.ModeSymlink | 0777)
+			body = strings.NewReader(e.link)
+		}
+		w, err := zw.CreateHeader(header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.Copy(w, body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func TestExtractChartSource(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []testSourceEntry
+		// files which must exist in the extracted directory
+		want    []string
+		wantErr string
+	}{
+		{
+			name: "chart",
+			entries: []testSourceEntry{
+				{name: "mychart/Chart.yaml", body: "name: mychart"},
+				{name: "mychart/templates/service.yaml", body: "kind: Service"},
+			},
+			want: []string{"mychart/Chart.yaml", "mychart/templates/service.yaml"},
+		},
+		{
+			name:    "parent directory",
+			entries: []testSourceEntry{{name: "../escaped.yaml", body: "escaped"}},
+			wantErr: "illegal file path",
+		},
+		{
+			name:    "parent directory inside a path",
+			entries: []testSourceEntry{{name: "mychart/../../escaped.yaml", body: "escaped"}},
+			wantErr: "illegal file path",
+		},
+		{
+			name:    "absolute path",
+			entries: []testSourceEntry{{name: "/mychart/Chart.yaml", body: "name: mychart"}},
+			want:    []string{"mychart/Chart.yaml"},
+		},
+		{
+			name: "symlinks",
+			entries: []testSourceEntry{
+				{name: "mychart/Chart.yaml", body: "name: mychart"},
+				{name: "mychart/values.yaml", link: "/etc/passwd"},
+				{name: "mychart/templates", link: "../.."},
+				{name: "mychart/templates/service.yaml", body: "kind: Service"},
+			},
+			want: []string{"mychart/Chart.yaml", "mychart/templates/service.yaml"},
+		},
+		{
+			name: "oversized",
+			entries: []testSourceEntry{
+				{name: "mychart/Chart.yaml", body: "name: mychart"},
+				{name: "mychart/big", size: maxChartSourceSize / 2},
+				{name: "mychart/bigger", size: maxChartSourceSize/2 + 1},
+			},
+			wantErr: "exceeds",
+		},
+	}
+
+	formats := []struct {
+		name    string
+		archive func(t *testing.T, entries []testSourceEntry) []byte
+	}{
+		{name: "tar", archive: func(t *testing.T, entries []testSourceEntry) []byte { return newTestTar(t, entries, false) }},
+		{name: "tgz", archive: func(t *testing.T, entries []testSourceEntry) []byte { return newTestTar(t, entries, true) }},
+		{name: "zip", archive: newTestZip},
+	}
+
+	for _, format := range formats {
+		t.Run(format.name, func(t *testing.T) {
+			for _, tt := range tests {
+				t.Run(tt.name, func(t *testing.T) {
+					root := t.TempDir()
+					dir := filepath.Join(root, "source")
+					err := extractChartSource(format.archive(t, tt.entries), dir)
+					if _, statErr := os.Stat(filepath.Join(root, "escaped.yaml")); statErr == nil {
+						t.Fatal("an entry was written outside of the directory")
+					}
+					if tt.wantErr != "" {
+						if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+							t.Fatalf("got error %v, want %q", err, tt.wantErr)
+						}
+						return
+					}
+					if err != nil {
+						t.Fatal(err)
+					}
+					for _, f := range tt.want {
+						info, err := os.Lstat(filepath.Join(dir, f))
+						if err != nil {
+							t.Errorf("%s: %s", f, err)
+							continue
+						}
+						if !info.Mode().IsRegular() {
+							t.Errorf("%s: got mode %s, want a regular file", f, info.Mode())
+						}
+					}
+					err = filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+						if err != nil {
+							return err
+						}
+						if info.Mode()&os.ModeSymlink != 0 {
+							t.Errorf("symlink %s was extracted", p)
+						}
+						return nil
+					})
+					if err != nil {
+						t.Fatal(err)
+					}
+				})
+			}
+		})
+	}
+}
@@ -0,0 +1,532 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"helm.sh/helm/v3/pkg/helmpath"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/discovery/cached/memory"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/restmapper"
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+)
+
+const clusterCheckTimeout = 5 * time.Second
+
+var clusterNameRegexp = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`)
+
+type ClusterConfig struct {
+	// Path of the cluster registry, default clusters.json in the helm config
+	// directory
+	Path string `yaml:"path"`
+	// KeyFile holds the key encrypting the cluster credentials, it falls back
+	// to the HELM_WRAPPER_CLUSTER_KEY environment variable
+	KeyFile string `yaml:"keyFile"`
+}
+
+// clusterRegistration is the request registering a cluster, either with the
+// content of a kubeconfig or with a server url and a token.
+type clusterRegistration struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	// kubeconfig content, and the context to use, default its current context
+	Kubeconfig string `json:"kubeconfig"`
+	Context    string `json:"context"`
+	// server url, bearer token and PEM encoded CA
+	Server                string `json:"server"`
+	Token                 string `json:"token"`
+	CA                    string `json:"ca"`
+	InsecureSkipTLSverify bool   `json:"insecure_skip_verify"`
+}
+
+// clusterRecord is a registered cluster as stored, the credentials are
+// encrypted.
+type clusterRecord struct {
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	Server      string    `json:"server"`
+	Created     time.Time `json:"created"`
+	Credentials string    `json:"credentials"`
+}
+
+type clusterElement struct {
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	Server      string    `json:"server"`
+	Created     time.Time `json:"created"`
+	Connected   bool      `json:"connected"`
+	Version     string    `json:"version,omitempty"`
+	Error       string    `json:"error,omitempty"`
+}
+
+type clusterRegistry struct {
+	sync.RWMutex
+	path     string
+	key      []byte
+	clusters map[string]*clusterRecord
+}
+
+var managedClusters = &clusterRegistry{clusters: map[string]*clusterRecord{}}
+
+func clusterConfig() *ClusterConfig {
+	if helmConfig.Clusters == nil {
+		return &ClusterConfig{}
+	}
+
+	return helmConfig.Clusters
+}
+
+// initClusters loads the cluster registry and the key of its credentials.
+func initClusters() error {
+	config := clusterConfig()
+	managedClusters.path = config.Path
+	if managedClusters.path == "" {
+		managedClusters.path = helmpath.ConfigPath("clusters.json")
+	}
+
+	var key []byte
+	if config.KeyFile != "" {
+		data, err := os.ReadFile(config.KeyFile)
+		if err != nil {
+			return fmt.Errorf("failed to read cluster key: %s", err)
+		}
+		key = []byte(strings.TrimRight(string(data), "\r\n"))
+	} else if env := os.Getenv("HELM_WRAPPER_CLUSTER_KEY"); env != "" {
+		key = []byte(env)
+	}
+	if len(key) > 0 {
+		sum := sha256.Sum256(key)
+		managedClusters.key = sum[:]
+	}
+
+	data, err := os.ReadFile(managedClusters.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	var records []*clusterRecord
+	err = json.Unmarshal(data, &records)
+	if err != nil {
+		return fmt.Errorf("invalid cluster registry %s: %s", managedClusters.path, err)
+	}
+	if len(records) > 0 && managedClusters.key == nil {
+		return errors.New("no cluster key configured to decrypt the registered clusters")
+	}
+	for _, r := range records {
+		managedClusters.clusters[r.Name] = r
+	}
+
+	return nil
+}
+
+func (r *clusterRegistry) encrypt(data []byte) (string, error) {
+	if r.key == nil {
+		return "", errors.New("no cluster key configured, set clusters.keyFile or HELM_WRAPPER_CLUSTER_KEY")
+	}
+	block, err := aes.NewCipher(r.key)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(gcm.Seal(nonce, nonce, data, nil)), nil
+}
+
+func (r *clusterRegistry) decrypt(s string) ([]byte, error) {
+	if r.key == nil {
+		return nil, errors.New("no cluster key configured")
+	}
+	data, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(r.key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < gcm.NonceSize() {
+		return nil, errors.New("invalid cluster credentials")
+	}
+
+	return gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+}
+
+// save writes the registry, the caller holds the lock.
+func (r *clusterRegistry) save() error {
+	records := make([]*clusterRecord, 0, len(r.clusters))
+	for _, c := range r.clusters {
+		records = append(records, c)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Name < records[j].Name
+	})
+	data, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(r.path), 0755)
+	if err != nil {
+		return err
+	}
+	tmp := r.path + ".tmp"
+	err = os.WriteFile(tmp, data, 0600)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, r.path)
+}
+
+func (r *clusterRegistry) register(reg *clusterRegistration, force bool) (*clusterRecord, error) {
+	if !clusterNameRegexp.MatchString(reg.Name) {
+		return nil, fmt.Errorf("invalid cluster name %q", reg.Name)
+	}
+	config, err := reg.kubeConfig()
+	if err != nil {
+		return nil, err
+	}
+	credentials, err := json.Marshal(reg)
+	if err != nil {
+		return nil, err
+	}
+
+	r.Lock()
+	defer r.Unlock()
+	if _, ok := r.clusters[reg.Name]; ok && !force {
+		return nil, fmt.Errorf("cluster %s already exists, use force to overwrite it", reg.Name)
+	}
+	encrypted, err := r.encrypt(credentials)
+	if err != nil {
+		return nil, err
+	}
+
+	record := &clusterRecord{
+		Name:        reg.Name,
+		Description: reg.Description,
+		Server:      config.Clusters[config.Contexts[config.CurrentContext].Cluster].Server,
+		Created:     time.Now(),
+		Credentials: encrypted,
+	}
+	previous, exists := r.clusters[reg.Name]
+	r.clusters[reg.Name] = record
+	err = r.save()
+	if err != nil {
+		if exists {
+			r.clusters[reg.Name] = previous
+		} else {
+			delete(r.clusters, reg.Name)
+		}
+		return nil, err
+	}
+	kubeClients.invalidateCluster(reg.Name)
+
+	return record, nil
+}
+
+func (r *clusterRegistry) remove(name string) error {
+	r.Lock()
+	defer r.Unlock()
+	record, ok := r.clusters[name]
+	if !ok {
+		return fmt.Errorf("cluster %s not found", name)
+	}
+	delete(r.clusters, name)
+	err := r.save()
+	if err != nil {
+		r.clusters[name] = record
+		return err
+	}
+	kubeClients.invalidateCluster(name)
+
+	return nil
+}
+
+func (r *clusterRegistry) list() []*clusterRecord {
+	r.RLock()
+	defer r.RUnlock()
+	records := make([]*clusterRecord, 0, len(r.clusters))
+	for _, c := range r.clusters {
+		records = append(records, c)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Name < records[j].Name
+	})
+
+	return records
+}
+
+// registration returns the decrypted registration of a cluster.
+func (r *clusterRegistry) registration(name string) (*clusterRegistration, error) {
+	r.RLock()
+	record, ok := r.clusters[name]
+	r.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("cluster %s not found", name)
+	}
+
+	data, err := r.decrypt(record.Credentials)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt credentials of cluster %s: %s", name, err)
+	}
+	var reg clusterRegistration
+	err = json.Unmarshal(data, &reg)
+	if err != nil {
+		return nil, err
+	}
+
+	return &reg, nil
+}
+
+// restClientGetter returns the client getter of a registered cluster for a
+// namespace, kube_context selects another context of its kubeconfig.
+func (r *clusterRegistry) restClientGetter(kubeInfo *KubeInformation) (*clusterRESTClientGetter, error) {
+	reg, err := r.registration(kubeInfo.AimCluster)
+	if err != nil {
+		return nil, err
+	}
+	if kubeInfo.AimContext != "" {
+		reg.Context = kubeInfo.AimContext
+	}
+	config, err := reg.kubeConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	overrides := &clientcmd.ConfigOverrides{}
+	overrides.Context.Namespace = kubeInfo.AimNamespace
+	overrides.AuthInfo.Impersonate = kubeInfo.AimImpersonate
+	overrides.AuthInfo.ImpersonateGroups = kubeInfo.AimImpersonateGroups
+	if kubeInfo.AimTimeout > 0 {
+		overrides.Timeout = kubeInfo.AimTimeout.String()
+	}
+	return &clusterRESTClientGetter{
+		clientConfig: clientcmd.NewNonInteractiveClientConfig(*config, config.CurrentContext, overrides, nil),
+	}, nil
+}
+
+// kubeConfig builds the kubeconfig of a registration. Kubeconfigs which
+// execute commands or read local files are refused, they would run on the
+// server.
+func (reg *clusterRegistration) kubeConfig() (*clientcmdapi.Config, error) {
+	if reg.Kubeconfig == "" {
+		if reg.Server == "" {
+			return nil, errors.New("kubeconfig or server can not be empty")
+		}
+		config := clientcmdapi.NewConfig()
+		config.Clusters["cluster"] = &clientcmdapi.Cluster{
+			Server:                   reg.Server,
+			CertificateAuthorityData: []byte(reg.CA),
+			InsecureSkipTLSVerify:    reg.InsecureSkipTLSverify,
+		}
+		config.AuthInfos["user"] = &clientcmdapi.AuthInfo{Token: reg.Token}
+		config.Contexts["default"] = &clientcmdapi.Context{Cluster: "cluster", AuthInfo: "user"}
+		config.CurrentContext = "default"
+		return config, nil
+	}
+
+	config, err := clientcmd.Load([]byte(reg.Kubeconfig))
+	if err != nil {
+		return nil, fmt.Errorf("invalid kubeconfig: %s", err)
+	}
+	if reg.Context != "" {
+		config.CurrentContext = reg.Context
+	}
+	context, ok := config.Contexts[config.CurrentContext]
+	if !ok {
+		return nil, fmt.Errorf("context %q not found in kubeconfig", config.CurrentContext)
+	}
+	if _, ok := config.Clusters[context.Cluster]; !ok {
+		return nil, fmt.Errorf("cluster %q not found in kubeconfig", context.Cluster)
+	}
+	// kube_context may select any context of the kubeconfig
+	for _, cluster := range config.Clusters {
+		if cluster.CertificateAuthority != "" {
+			return nil, errors.New("kubeconfig can not reference files, use certificate-authority-data")
+		}
+	}
+	for _, authInfo := range config.AuthInfos {
+		if authInfo.Exec != nil || authInfo.AuthProvider != nil {
+			return nil, errors.New("kubeconfig can not use exec or auth provider plugins")
+		}
+		if authInfo.ClientCertificate != "" || authInfo.ClientKey != "" || authInfo.TokenFile != "" {
+			return nil, errors.New("kubeconfig can not reference files, use client-certificate-data, client-key-data or token")
+		}
+	}
+
+	return config, nil
+}
+
+// clusterRESTClientGetter serves the clients of a registered cluster from
+// its kubeconfig in memory. The discovery client and REST mapper are kept,
+// like the persistent config of genericclioptions.ConfigFlags.
+type clusterRESTClientGetter struct {
+	clientConfig clientcmd.ClientConfig
+
+	lock            sync.Mutex
+	discoveryClient discovery.CachedDiscoveryInterface
+	restMapper      meta.RESTMapper
+}
+
+func (g *clusterRESTClientGetter) ToRESTConfig() (*rest.Config, error) {
+	return g.clientConfig.ClientConfig()
+}
+
+func (g *clusterRESTClientGetter) ToDiscoveryClient() (discovery.CachedDiscoveryInterface, error) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return g.toDiscoveryClient()
+}
+
+func (g *clusterRESTClientGetter) toDiscoveryClient() (discovery.CachedDiscoveryInterface, error) {
+	if g.discoveryClient != nil {
+		return g.discoveryClient, nil
+	}
+
+	config, err := g.ToRESTConfig()
+	if err != nil {
+		return nil, err
+	}
+	// discovery of clusters with many resources bursts
+	config.Burst = 300
+	dc, err := discovery.NewDiscoveryClientForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	g.discoveryClient = memory.NewMemCacheClient(dc)
+
+	return g.discoveryClient, nil
+}
+
+func (g *clusterRESTClientGetter) ToRESTMapper() (meta.RESTMapper, error) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if g.restMapper != nil {
+		return g.restMapper, nil
+	}
+
+	dc, err := g.toDiscoveryClient()
+	if err != nil {
+		return nil, err
+	}
+	mapper := restmapper.NewDeferredDiscoveryRESTMapper(dc)
+	g.restMapper = restmapper.NewShortcutExpander(mapper, dc, nil)
+
+	return g.restMapper, nil
+}
+
+func (g *clusterRESTClientGetter) ToRawKubeConfigLoader() clientcmd.ClientConfig {
+	return g.clientConfig
+}
+
+// checkCluster reports the connectivity and the kubernetes version of a
+// registered cluster.
+func checkCluster(record *clusterRecord) clusterElement {
+	element := clusterElement{
+		Name:        record.Name,
+		Description: record.Description,
+		Server:      record.Server,
+		Created:     record.Created,
+	}
+
+	getter, err := managedClusters.restClientGetter(&KubeInformation{AimCluster: record.Name})
+	if err != nil {
+		element.Error = err.Error()
+		return element
+	}
+	config, err := getter.ToRESTConfig()
+	if err != nil {
+		element.Error = err.Error()
+		return element
+	}
+	config.Timeout = clusterCheckTimeout
+	dc, err := discovery.NewDiscoveryClientForConfig(config)
+	if err != nil {
+		element.Error = err.Error()
+		return element
+	}
+	info, err := dc.ServerVersion()
+	if err != nil {
+		element.Error = err.Error()
+		return element
+	}
+	element.Connected = true
+	element.Version = info.GitVersion
+
+	return element
+}
+
+func listClusters(c *gin.Context) {
+	records := managedClusters.list()
+	elements := make([]clusterElement, len(records))
+
+	var wg sync.WaitGroup
+	for i, record := range records {
+		wg.Add(1)
+		go func(i int, record *clusterRecord) {
+			defer wg.Done()
+			elements[i] = checkCluster(record)
+		}(i, record)
+	}
+	wg.Wait()
+
+	respOK(c, elements)
+}
+
+func registerCluster(c *gin.Context) {
+	var reg clusterRegistration
+	err := c.ShouldBindJSON(&reg)
+	if err != nil {
+		respErr(c, err)
+		return
+	}
+
+	record, err := managedClusters.register(&reg, c.Query("force") == "true")
+	if err != nil {
+		respErr(c, err)
+		return
+	}
+
+	respOK(c, checkCluster(record))
+}
+
+func removeCluster(c *gin.Context) {
+	err := managedClusters.remove(c.Param("cluster"))
+	if err != nil {
+		respErr(c, err)
+		return
+	}
+
+	respOK(c, nil)
+}
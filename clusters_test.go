@@ -0,0 +1,166 @@
+package main
+
+import (
+	"crypto/sha256"
+	"strings"
+	"testing"
+)
+
+func newTestClusterRegistry(key string) *clusterRegistry {
+	sum := sha256.Sum256([]byte(key))
+	return &clusterRegistry{key: sum[:], clusters: map[string]*clusterRecord{}}
+}
+
+func TestClusterCredentialsEncryption(t *testing.T) {
+	r := newTestClusterRegistry("key")
+	secret := []byte(`{"token":"secret"}`)
+	encrypted, err := r.encrypt(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(encrypted, "secret") {
+		t.Fatalf("credentials are stored in plain text: %s", encrypted)
+	}
+	again, err := r.encrypt(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again == encrypted {
+		t.Error("encrypting twice gave the same ciphertext, the nonce is reused")
+	}
+
+	decrypted, err := r.decrypt(encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(decrypted) != string(secret) {
+		t.Errorf("got %s, want %s", decrypted, secret)
+	}
+
+	if _, err := newTestClusterRegistry("other key").decrypt(encrypted); err == nil {
+		t.Error("decrypt with a wrong key: expected an error")
+	}
+	if _, err := (&clusterRegistry{}).decrypt(encrypted); err == nil {
+		t.Error("decrypt without a key: expected an error")
+	}
+	if _, err := (&clusterRegistry{}).encrypt(secret); err == nil {
+		t.Error("encrypt without a key: expected an error")
+	}
+	if _, err := r.decrypt(encrypted[:8]); err == nil {
+		t.Error("decrypt of truncated credentials: expected an error")
+	}
+}
+
+const testKubeconfigTemplate = `apiVersion: v1
+kind: Config
+clusters:
+- name: prod
+  cluster:
+    server: https://prod.example.com
+    certificate-authority-data: Y2E=
+- name: staging
+  cluster:
+    server: https://staging.example.com
+%s
+contexts:
+- name: prod
+  context:
+    cluster: prod
+    user: prod
+- name: staging
+  context:
+    cluster: staging
+    user: staging
+current-context: prod
+users:
+- name: prod
+  user:
+    token: prod
+- name: staging
+  user:
+%s
+`
+
+func TestClusterRegistrationKubeConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		reg     clusterRegistration
+		wantErr string
+	}{
+		{
+			name: "server and token",
+			reg:  clusterRegistration{Server: "https://prod.example.com", Token: "prod"},
+		},
+		{
+			name: "kubeconfig",
+			reg:  clusterRegistration{Kubeconfig: newTestKubeconfig("", "    token: staging")},
+		},
+		{
+			name:    "no kubeconfig and no server",
+			reg:     clusterRegistration{Token: "prod"},
+			wantErr: "can not be empty",
+		},
+		{
+			name:    "unknown context",
+			reg:     clusterRegistration{Kubeconfig: newTestKubeconfig("", "    token: staging"), Context: "dev"},
+			wantErr: `context "dev" not found`,
+		},
+		{
+			name: "exec plugin",
+			reg: clusterRegistration{Kubeconfig: newTestKubeconfig("", `    exec:
+      apiVersion: client.authentication.k8s.io/v1
+      command: /bin/sh`)},
+			wantErr: "exec or auth provider",
+		},
+		{
+			name: "auth provider",
+			reg: clusterRegistration{Kubeconfig: newTestKubeconfig("", `    auth-provider:
+      name: oidc`)},
+			wantErr: "exec or auth provider",
+		},
+		{
+			name:    "client certificate file",
+			reg:     clusterRegistration{Kubeconfig: newTestKubeconfig("", "    client-certificate: /etc/passwd")},
+			wantErr: "can not reference files",
+		},
+		{
+			name:    "client key file",
+			reg:     clusterRegistration{Kubeconfig: newTestKubeconfig("", "    client-key: /etc/passwd")},
+			wantErr: "can not reference files",
+		},
+		{
+			name:    "token file",
+			reg:     clusterRegistration{Kubeconfig: newTestKubeconfig("", "    tokenFile: /etc/passwd")},
+			wantErr: "can not reference files",
+		},
+		{
+			name:    "certificate authority file of a context which is not current",
+			reg:     clusterRegistration{Kubeconfig: newTestKubeconfig("    certificate-authority: /etc/passwd", "    token: staging")},
+			wantErr: "can not reference files",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config, err := tt.reg.kubeConfig()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := config.Contexts[config.CurrentContext]; !ok {
+				t.Errorf("current context %q not found", config.CurrentContext)
+			}
+		})
+	}
+}
+
+// newTestKubeconfig returns a kubeconfig with extra fields of the staging
+// cluster and user.
+func newTestKubeconfig(cluster, user string) string {
+	return strings.Replace(strings.Replace(testKubeconfigTemplate, "%s", cluster, 1), "%s", user, 1)
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+
+	"github.com/gin-gonic/gin"
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/release"
+	"helm.sh/helm/v3/pkg/releaseutil"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	releaseIdentical = "identical"
+	releaseDrifted   = "drifted"
+	releaseUnknown   = "unknown"
+)
+
+type compareReleasesRequest struct {
+	Targets []releaseTarget `json:"targets"`
+}
+
+type releaseSnapshot struct {
+	releaseTarget
+	Revision     int    `json:"revision,omitempty"`
+	Status       string `json:"status,omitempty"`
+	Chart        string `json:"chart,omitempty"`
+	ChartVersion string `json:"chart_version,omitempty"`
+	AppVersion   string `json:"app_version,omitempty"`
+	Error        string `json:"error,omitempty"`
+}
+
+type releaseDrift struct {
+	// From and To are the indexes of the compared targets
+	From      int              `json:"from"`
+	To        int              `json:"to"`
+	Metadata  []chartChange    `json:"metadata"`  // chart, chart_version and app_version
+	Values    []chartChange    `json:"values"`    // user supplied values
+	Manifests chartFileChanges `json:"manifests"` // <kind>/<name> of the resources
+}
+
+type releaseComparison struct {
+	Release string             `json:"release"`
+	Targets []*releaseSnapshot `json:"targets"`
+	// Matrix reports for each pair of targets whether their releases are
+	// identical or drifted, unknown if a release could not be read
+	Matrix      [][]string      `json:"matrix"`
+	Differences []*releaseDrift `json:"differences"`
+}
+
+// releaseState is the part of a release compared across clusters.
+type releaseState struct {
+	metadata  map[string]interface{}
+	values    map[string]interface{}
+	resources map[string]interface{}
+}
+
+// manifestResources parses a rendered manifest into its resources, keyed by
+// <kind>/<name>. The namespace of the resources is dropped.
+func manifestResources(manifest string) (map[string]interface{}, error) {
+	resources := map[string]interface{}{}
+	for _, m := range releaseutil.SplitManifests(manifest) {
+		var obj map[string]interface{}
+		err := yaml.Unmarshal([]byte(m), &obj)
+		if err != nil {
+			return nil, fmt.Errorf("failed parsing manifest: %s", err)
+		}
+		if obj == nil {
+			continue
+		}
+		kind, _ := obj["kind"].(string)
+		var name string
+		if metadata, ok := obj["metadata"].(map[string]interface{}); ok {
+			name, _ = metadata["name"].(string)
+			// charts set the namespace of the release, it differs between
+			// the compared targets
+			delete(metadata, "namespace")
+		}
+		resources[kind+"/"+name] = obj
+	}
+
+	return resources, nil
+}
+
+func newReleaseState(rls *release.Release) (*releaseState, error) {
+	resources, err := manifestResources(releaseManifest(rls))
+	if err != nil {
+		return nil, err
+	}
+
+	return &releaseState{
+		metadata: map[string]interface{}{
+			"chart":         rls.Chart.Metadata.Name,
+			"chart_version": rls.Chart.Metadata.Version,
+			"app_version":   rls.Chart.Metadata.AppVersion,
+		},
+		values:    flattenValues("", rls.Config, map[string]interface{}{}),
+		resources: resources,
+	}, nil
+}
+
+func diffResources(from, to map[string]interface{}) chartFileChanges {
+	changes := chartFileChanges{Added: []string{}, Removed: []string{}, Changed: []string{}}
+	for k, obj := range to {
+		fromObj, ok := from[k]
+		if !ok {
+			changes.Added = append(changes.Added, k)
+		} else if !reflect.DeepEqual(fromObj, obj) {
+			changes.Changed = append(changes.Changed, k)
+		}
+	}
+	for k := range from {
+		if _, ok := to[k]; !ok {
+			changes.Removed = append(changes.Removed, k)
+		}
+	}
+	sort.Strings(changes.Added)
+	sort.Strings(changes.Removed)
+	sort.Strings(changes.Changed)
+
+	return changes
+}
+
+// diffReleaseStates returns the differences of two releases, nil if they are
+// identical.
+func diffReleaseStates(from, to *releaseState) *releaseDrift {
+	drift := &releaseDrift{
+		Metadata:  diffMaps(from.metadata, to.metadata),
+		Values:    diffMaps(from.values, to.values),
+		Manifests: diffResources(from.resources, to.resources),
+	}
+	if len(drift.Metadata) == 0 && len(drift.Values) == 0 && len(drift.Manifests.Added) == 0 &&
+		len(drift.Manifests.Removed) == 0 && len(drift.Manifests.Changed) == 0 {
+		return nil
+	}
+
+	return drift
+}
+
+// compareReleases compares a release across clusters and namespaces using
+// the stored release records.
+func compareReleases(c *gin.Context) {
+	name := c.Param("release")
+
+	var req compareReleasesRequest
+	err := c.ShouldBindJSON(&req)
+	if err != nil {
+		respErr(c, err)
+		return
+	}
+	if len(req.Targets) < 2 {
+		respErr(c, fmt.Errorf("at least two targets are required"))
+		return
+	}
+	for _, target := range req.Targets {
+		if target.Namespace == "" {
+			respErr(c, fmt.Errorf("namespace of target %s can not be empty", target.clusterTarget))
+			return
+		}
+		if target.Cluster != "" {
+			if _, err := managedClusters.registration(target.Cluster); err != nil {
+				respErr(c, err)
+				return
+			}
+		}
+	}
+	timeout, err := clusterTimeout(c)
+	if err != nil {
+		respErr(c, err)
+		return
+	}
+
+	clusters := make([]clusterTarget, 0, len(req.Targets))
+	for _, target := range req.Targets {
+		clusters = append(clusters, target.clusterTarget)
+	}
+	results := fanOutClusters(clusters, timeout, func(i int, _ clusterTarget) (interface{}, error) {
+		actionConfig, err := actionConfigInit(fanOutKubeInformation(req.Targets[i], timeout))
+		if err != nil {
+			return nil, err
+		}
+		return action.NewGet(actionConfig).Run(name)
+	})
+
+	comparison := &releaseComparison{
+		Release:     name,
+		Differences: []*releaseDrift{},
+	}
+	states := make([]*releaseState, len(results))
+	for i, result := range results {
+		snapshot := &releaseSnapshot{releaseTarget: req.Targets[i]}
+		comparison.Targets = append(comparison.Targets, snapshot)
+		if result.err == nil {
+			rls := result.value.(*release.Release)
+			snapshot.Revision = rls.Version
+			snapshot.Status = rls.Info.Status.String()
+			snapshot.Chart = rls.Chart.Metadata.Name
+			snapshot.ChartVersion = rls.Chart.Metadata.Version
+			snapshot.AppVersion = rls.Chart.Metadata.AppVersion
+			states[i], result.err = newReleaseState(rls)
+		}
+		if result.err != nil {
+			snapshot.Error = result.err.Error()
+		}
+	}
+
+	comparison.Matrix = make([][]string, len(states))
+	for i := range states {
+		comparison.Matrix[i] = make([]string, len(states))
+	}
+	for i := range states {
+		for j := i; j < len(states); j++ {
+			status := releaseUnknown
+			if states[i] != nil && states[j] != nil {
+				status = releaseIdentical
+				if drift := diffReleaseStates(states[i], states[j]); drift != nil {
+					drift.From, drift.To = i, j
+					comparison.Differences = append(comparison.Differences, drift)
+					status = releaseDrifted
+				}
+			}
+			comparison.Matrix[i][j] = status
+			comparison.Matrix[j][i] = status
+		}
+	}
+
+	respOK(c, comparison)
+}
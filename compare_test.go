@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/release"
+)
+
+const testCompareManifest = `---
+apiVersion: v1
+kind: Service
+metadata:
+  name: web
+  namespace: %s
+spec:
+  ports:
+  - port: %s
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+  namespace: %s
+spec:
+  replicas: 2
+`
+
+func newTestCompareRelease(namespace, port string, values map[string]interface{}) *release.Release {
+	return &release.Release{
+		Name:      "web",
+		Namespace: namespace,
+		Chart:     &chart.Chart{Metadata: &chart.Metadata{Name: "web", Version: "0.1.0", AppVersion: "1.0"}},
+		Config:    values,
+		Manifest:  fmt.Sprintf(testCompareManifest, namespace, port, namespace),
+	}
+}
+
+func TestDiffReleaseStates(t *testing.T) {
+	tests := []struct {
+		name      string
+		from, to  *release.Release
+		want      bool // drifted
+		changed   []string
+		valueDiff []string
+	}{
+		{
+			name: "same release in another namespace",
+			from: newTestCompareRelease("staging", "80", map[string]interface{}{"replicas": 2}),
+			to:   newTestCompareRelease("prod", "80", map[string]interface{}{"replicas": 2}),
+		},
+		{
+			name:    "changed resource",
+			from:    newTestCompareRelease("staging", "80", nil),
+			to:      newTestCompareRelease("prod", "8080", nil),
+			want:    true,
+			changed: []string{"Service/web"},
+		},
+		{
+			name:      "changed values",
+			from:      newTestCompareRelease("staging", "80", map[string]interface{}{"replicas": 2}),
+			to:        newTestCompareRelease("staging", "80", map[string]interface{}{"replicas": 3}),
+			want:      true,
+			valueDiff: []string{"replicas"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			from, err := newReleaseState(tt.from)
+			if err != nil {
+				t.Fatal(err)
+			}
+			to, err := newReleaseState(tt.to)
+			if err != nil {
+				t.Fatal(err)
+			}
+			drift := diffReleaseStates(from, to)
+			if (drift != nil) != tt.want {
+				t.Fatalf("got drift %+v, want drifted %v", drift, tt.want)
+			}
+			if drift == nil {
+				return
+			}
+			if tt.changed == nil {
+				tt.changed = []string{}
+			}
+			if !reflect.DeepEqual(drift.Manifests.Changed, tt.changed) {
+				t.Errorf("got changed resources %v, want %v", drift.Manifests.Changed, tt.changed)
+			}
+			var values []string
+			for _, change := range drift.Values {
+				values = append(values, change.Path)
+			}
+			if !reflect.DeepEqual(values, tt.valueDiff) {
+				t.Errorf("got changed values %v, want %v", values, tt.valueDiff)
+			}
+		})
+	}
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/release"
+	"helm.sh/helm/v3/pkg/releaseutil"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	apiDeprecated = "deprecated"
+	apiRemoved    = "removed"
+)
+
+type apiDeprecation struct {
+	APIVersion   string
+	Kinds        []string // empty for all kinds of the api version
+	DeprecatedIn string
+	RemovedIn    string
+	Replacement  string
+}
+
+// deprecatedAPIs is the table of deprecated and removed api versions, from
+// https://kubernetes.io/docs/reference/using-api/deprecation-guide/
+var deprecatedAPIs = []apiDeprecation{
+	{"extensions/v1beta1", []string{"Deployment", "DaemonSet", "ReplicaSet"}, "1.9", "1.16", "apps/v1"},
+	{"extensions/v1beta1", []string{"NetworkPolicy"}, "1.9", "1.16", "networking.k8s.io/v1"},
+	{"extensions/v1beta1", []string{"PodSecurityPolicy"}, "1.11", "1.16", "policy/v1beta1"},
+	{"extensions/v1beta1", []string{"Ingress"}, "1.14", "1.22", "networking.k8s.io/v1"},
+	{"apps/v1beta1", nil, "1.9", "1.16", "apps/v1"},
+	{"apps/v1beta2", nil, "1.9", "1.16", "apps/v1"},
+	{"admissionregistration.k8s.io/v1beta1", nil, "1.16", "1.22", "admissionregistration.k8s.io/v1"},
+	{"apiextensions.k8s.io/v1beta1", nil, "1.16", "1.22", "apiextensions.k8s.io/v1"},
+	{"apiregistration.k8s.io/v1beta1", nil, "1.19", "1.22", "apiregistration.k8s.io/v1"},
+	{"authentication.k8s.io/v1beta1", nil, "1.19", "1.22", "authentication.k8s.io/v1"},
+	{"authorization.k8s.io/v1beta1", nil, "1.19", "1.22", "authorization.k8s.io/v1"},
+	{"certificates.k8s.io/v1beta1", nil, "1.19", "1.22", "certificates.k8s.io/v1"},
+	{"coordination.k8s.io/v1beta1", nil, "1.19", "1.22", "coordination.k8s.io/v1"},
+	{"networking.k8s.io/v1beta1", []string{"Ingress", "IngressClass"}, "1.19", "1.22", "networking.k8s.io/v1"},
+	{"rbac.authorization.k8s.io/v1beta1", nil, "1.17", "1.22", "rbac.authorization.k8s.io/v1"},
+	{"scheduling.k8s.io/v1beta1", nil, "1.14", "1.22", "scheduling.k8s.io/v1"},
+	{"storage.k8s.io/v1beta1", []string{"CSIDriver", "CSINode", "StorageClass", "VolumeAttachment"}, "1.19", "1.22", "storage.k8s.io/v1"},
+	{"batch/v1beta1", []string{"CronJob"}, "1.21", "1.25", "batch/v1"},
+	{"discovery.k8s.io/v1beta1", []string{"EndpointSlice"}, "1.21", "1.25", "discovery.k8s.io/v1"},
+	{"events.k8s.io/v1beta1", []string{"Event"}, "1.19", "1.25", "events.k8s.io/v1"},
+	{"autoscaling/v2beta1", []string{"HorizontalPodAutoscaler"}, "1.22", "1.25", "autoscaling/v2"},
+	{"policy/v1beta1", []string{"PodDisruptionBudget"}, "1.21", "1.25", "policy/v1"},
+	{"policy/v1beta1", []string{"PodSecurityPolicy"}, "1.21", "1.25", ""},
+	{"node.k8s.io/v1beta1", []string{"RuntimeClass"}, "1.20", "1.25", "node.k8s.io/v1"},
+	{"autoscaling/v2beta2", []string{"HorizontalPodAutoscaler"}, "1.23", "1.26", "autoscaling/v2"},
+	{"flowcontrol.apiserver.k8s.io/v1beta1", nil, "1.23", "1.26", "flowcontrol.apiserver.k8s.io/v1"},
+	{"storage.k8s.io/v1beta1", []string{"CSIStorageCapacity"}, "1.24", "1.27", "storage.k8s.io/v1"},
+	{"flowcontrol.apiserver.k8s.io/v1beta2", nil, "1.26", "1.29", "flowcontrol.apiserver.k8s.io/v1"},
+	{"flowcontrol.apiserver.k8s.io/v1beta3", nil, "1.29", "1.32", "flowcontrol.apiserver.k8s.io/v1"},
+}
+
+type apiFinding struct {
+	Resource     string `json:"resource"` // <kind>/<name>
+	APIVersion   string `json:"api_version"`
+	Kind         string `json:"kind"`
+	DeprecatedIn string `json:"deprecated_in"`
+	RemovedIn    string `json:"removed_in"`
+	Replacement  string `json:"replacement,omitempty"`
+	// Status is deprecated or removed in the target kubernetes version,
+	// empty if the api version still works there
+	Status string `json:"status,omitempty"`
+}
+
+type releaseAPIFindings struct {
+	Namespace   string       `json:"namespace"`
+	Release     string       `json:"release"`
+	KubeVersion string       `json:"kube_version"`
+	Findings    []apiFinding `json:"findings"`
+}
+
+// removedAPIError is returned when a release renders api versions which are
+// removed in the target kubernetes version.
+type removedAPIError struct {
+	KubeVersion string
+	Findings    []apiFinding
+}
+
+func (e *removedAPIError) Error() string {
+	resources := make([]string, 0, len(e.Findings))
+	for _, f := range e.Findings {
+		resources = append(resources, fmt.Sprintf("%s (%s)", f.Resource, f.APIVersion))
+	}
+
+	return fmt.Sprintf("api versions removed in kubernetes %s: %s", e.KubeVersion, strings.Join(resources, ", "))
+}
+
+// parseKubeMinor returns the major and minor version of a kubernetes version
+// like v1.25.3-eks-1.
+func parseKubeMinor(version string) (major, minor int, err error) {
+	parts := strings.SplitN(strings.TrimPrefix(version, "v"), ".", 3)
+	if len(parts) < 2 {
+		return 0, 0, fmt.Errorf("invalid kubernetes version %s", version)
+	}
+	major, err = strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid kubernetes version %s", version)
+	}
+	// minor versions of some providers carry a suffix, e.g. 25+
+	minor, err = strconv.Atoi(strings.TrimRight(parts[1], "+"))
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid kubernetes version %s", version)
+	}
+
+	return major, minor, nil
+}
+
+// kubeVersionAtLeast reports whether version is at or beyond min.
+func kubeVersionAtLeast(version, min string) (bool, error) {
+	major, minor, err := parseKubeMinor(version)
+	if err != nil {
+		return false, err
+	}
+	minMajor, minMinor, err := parseKubeMinor(min)
+	if err != nil {
+		return false, err
+	}
+
+	return major > minMajor || (major == minMajor && minor >= minMinor), nil
+}
+
+func findAPIDeprecation(apiVersion, kind string) *apiDeprecation {
+	for i, d := range deprecatedAPIs {
+		if d.APIVersion != apiVersion {
+			continue
+		}
+		if len(d.Kinds) == 0 {
+			return &deprecatedAPIs[i]
+		}
+		for _, k := range d.Kinds {
+			if k == kind {
+				return &deprecatedAPIs[i]
+			}
+		}
+	}
+
+	return nil
+}
+
+// checkManifestAPIs scans a rendered manifest for deprecated and removed api
+// versions. With a target kubernetes version the status of each finding is
+// set.
+func checkManifestAPIs(manifest, kubeVersion string) ([]apiFinding, error) {
+	manifests := releaseutil.SplitManifests(manifest)
+	keys := make([]string, 0, len(manifests))
+	for k := range manifests {
+		keys = append(keys, k)
+	}
+	sort.Sort(releaseutil.BySplitManifestsOrder(keys))
+
+	findings := []apiFinding{}
+	for _, k := range keys {
+		var obj struct {
+			APIVersion string `json:"apiVersion"`
+			Kind       string `json:"kind"`
+			Metadata   struct {
+				Name string `json:"name"`
+			} `json:"metadata"`
+		}
+		err := yaml.Unmarshal([]byte(manifests[k]), &obj)
+		if err != nil {
+			return nil, fmt.Errorf("failed parsing manifest: %s", err)
+		}
+
+		d := findAPIDeprecation(obj.APIVersion, obj.Kind)
+		if d == nil {
+			continue
+		}
+		finding := apiFinding{
+			Resource:     obj.Kind + "/" + obj.Metadata.Name,
+			APIVersion:   obj.APIVersion,
+			Kind:         obj.Kind,
+			DeprecatedIn: d.DeprecatedIn,
+			RemovedIn:    d.RemovedIn,
+			Replacement:  d.Replacement,
+		}
+		if kubeVersion != "" {
+			removed, err := kubeVersionAtLeast(kubeVersion, d.RemovedIn)
+			if err != nil {
+				return nil, err
+			}
+			deprecated, _ := kubeVersionAtLeast(kubeVersion, d.DeprecatedIn)
+			if removed {
+				finding.Status = apiRemoved
+			} else if deprecated {
+				finding.Status = apiDeprecated
+			}
+		}
+		findings = append(findings, finding)
+	}
+
+	return findings, nil
+}
+
+// targetKubeVersion returns the given kubernetes version, or the version of
+// the cluster.
+func targetKubeVersion(actionConfig *action.Configuration, kubeVersion string) (string, error) {
+	if kubeVersion != "" {
+		_, _, err := parseKubeMinor(kubeVersion)
+		return kubeVersion, err
+	}
+
+	dc, err := actionConfig.RESTClientGetter.ToDiscoveryClient()
+	if err != nil {
+		return "", err
+	}
+	info, err := dc.ServerVersion()
+	if err != nil {
+		return "", fmt.Errorf("failed to get kubernetes version: %s", err)
+	}
+
+	return info.GitVersion, nil
+}
+
+// checkReleaseAPIs is the pre-install/pre-upgrade gate, it refuses releases
+// rendering api versions which are removed in the target kubernetes version.
+func checkReleaseAPIs(actionConfig *action.Configuration, rls *release.Release, kubeVersion string) error {
+	kubeVersion, err := targetKubeVersion(actionConfig, kubeVersion)
+	if err != nil {
+		return err
+	}
+	findings, err := checkManifestAPIs(releaseManifest(rls), kubeVersion)
+	if err != nil {
+		return err
+	}
+
+	var removed []apiFinding
+	for _, f := range findings {
+		if f.Status == apiRemoved {
+			removed = append(removed, f)
+		}
+	}
+	if len(removed) > 0 {
+		return &removedAPIError{
+			KubeVersion: kubeVersion,
+			Findings:    removed,
+		}
+	}
+
+	return nil
+}
+
+func listReleaseDeprecations(c *gin.Context) {
+	name := c.Param("release")
+	namespace := c.Param("namespace")
+
+	actionConfig, err := actionConfigInit(kubeInformation(c, namespace))
+	if err != nil {
+		respErr(c, err)
+		return
+	}
+
+	client := action.NewGet(actionConfig)
+	rls, err := client.Run(name)
+	if err != nil {
+		respErr(c, err)
+		return
+	}
+	kubeVersion, err := targetKubeVersion(actionConfig, c.Query("kube_version"))
+	if err != nil {
+		respErr(c, err)
+		return
+	}
+	findings, err := checkManifestAPIs(releaseManifest(rls), kubeVersion)
+	if err != nil {
+		respErr(c, err)
+		return
+	}
+
+	respOK(c, &releaseAPIFindings{
+		Namespace:   rls.Namespace,
+		Release:     rls.Name,
+		KubeVersion: kubeVersion,
+		Findings:    findings,
+	})
+}
@@ -2,7 +2,9 @@ package main
 
 import (
 	"os"
+	"time"
 
+	"github.com/gin-gonic/gin"
 	"github.com/golang/glog"
 	"helm.sh/helm/v3/pkg/action"
 	"helm.sh/helm/v3/pkg/kube"
@@ -13,21 +15,39 @@ type KubeInformation struct {
 	AimNamespace string
 	AimContext   string
 	AimConfig    string
+	AimCluster   string // registered cluster
+	// impersonated user and groups
+	AimImpersonate       string
+	AimImpersonateGroups []string
+	// AimTimeout bounds every request of the kube clients, 0 is no timeout
+	AimTimeout time.Duration
 }
 
-func InitKubeInformation(namespace, context, config string) *KubeInformation {
+func InitKubeInformation(namespace, context, config, cluster string) *KubeInformation {
 	return &KubeInformation{
 		AimNamespace: namespace,
 		AimContext:   context,
 		AimConfig:    config,
+		AimCluster:   cluster,
 	}
 }
 
-func actionConfigInit(kubeInfo *KubeInformation) (*action.Configuration, error) {
-	actionConfig := new(action.Configuration)
-	if kubeInfo.AimContext == "" {
-		kubeInfo.AimContext = settings.KubeContext
+// kubeInformation reads the target cluster of a request from its
+// kube_context, kube_config, cluster, as and as_group parameters.
+func kubeInformation(c *gin.Context, namespace string) *KubeInformation {
+	kubeInfo := InitKubeInformation(namespace, c.Query("kube_context"), c.Query("kube_config"), c.Query("cluster"))
+	kubeInfo.AimImpersonate = c.Query("as")
+	kubeInfo.AimImpersonateGroups = c.QueryArray("as_group")
+
+	return kubeInfo
+}
+
+// newRESTClientGetter builds the kube clients of a target cluster.
+func newRESTClientGetter(kubeInfo *KubeInformation) (genericclioptions.RESTClientGetter, error) {
+	if kubeInfo.AimCluster != "" {
+		return managedClusters.restClientGetter(kubeInfo)
 	}
+
 	clientConfig := new(genericclioptions.ConfigFlags)
 	if kubeInfo.AimConfig == "" {
 		clientConfig = kube.GetConfig(settings.KubeConfig, kubeInfo.AimContext, kubeInfo.AimNamespace)
@@ -40,7 +60,31 @@ func actionConfigInit(kubeInfo *KubeInformation) (*action.Configuration, error)
 	if settings.KubeAPIServer != "" {
 		clientConfig.APIServer = &settings.KubeAPIServer
 	}
-	err := actionConfig.Init(clientConfig, kubeInfo.AimNamespace, os.Getenv("HELM_DRIVER"), glog.Infof)
+	if kubeInfo.AimImpersonate != "" {
+		clientConfig.Impersonate = &kubeInfo.AimImpersonate
+	}
+	if len(kubeInfo.AimImpersonateGroups) > 0 {
+		clientConfig.ImpersonateGroup = &kubeInfo.AimImpersonateGroups
+	}
+	if kubeInfo.AimTimeout > 0 {
+		timeout := kubeInfo.AimTimeout.String()
+		clientConfig.Timeout = &timeout
+	}
+
+	return clientConfig, nil
+}
+
+func actionConfigInit(kubeInfo *KubeInformation) (*action.Configuration, error) {
+	actionConfig := new(action.Configuration)
+	if kubeInfo.AimCluster == "" && kubeInfo.AimContext == "" {
+		kubeInfo.AimContext = settings.KubeContext
+	}
+
+	clients, err := kubeClients.get(kubeInfo)
+	if err != nil {
+		return nil, err
+	}
+	err = actionConfig.Init(clients.getter, kubeInfo.AimNamespace, os.Getenv("HELM_DRIVER"), glog.Infof)
 	if err != nil {
 		glog.Errorf("%+v", err)
 		return nil, err
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang/glog"
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/chartutil"
+	"helm.sh/helm/v3/pkg/helmpath"
+	"helm.sh/helm/v3/pkg/release"
+	"helm.sh/helm/v3/pkg/repo"
+	"helm.sh/helm/v3/pkg/strvals"
+	"sigs.k8s.io/yaml"
+)
+
+// uploadRepoName is the repository name of the chart repository of
+// uploaded charts in exported helmfiles.
+const uploadRepoName = "helm-wrapper"
+
+type helmfileRepository struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+	OCI  bool   `json:"oci,omitempty"`
+}
+
+type helmfileSetValue struct {
+	Name  string      `json:"name"`
+	Value interface{} `json:"value"`
+}
+
+type helmfileDefaults struct {
+	KubeContext     string `json:"kubeContext,omitempty"`
+	Wait            bool   `json:"wait,omitempty"`
+	Timeout         int    `json:"timeout,omitempty"` // seconds
+	Atomic          bool   `json:"atomic,omitempty"`
+	CreateNamespace *bool  `json:"createNamespace,omitempty"`
+}
+
+type helmfileRelease struct {
+	Name            string             `json:"name"`
+	Namespace       string             `json:"namespace,omitempty"`
+	Chart           string             `json:"chart"`
+	Version         string             `json:"version,omitempty"`
+	Values          []interface{}      `json:"values,omitempty"` // inline values, files are not supported
+	Set             []helmfileSetValue `json:"set,omitempty"`
+	Needs           []string           `json:"needs,omitempty"`
+	Installed       *bool              `json:"installed,omitempty"`
+	KubeContext     string             `json:"kubeContext,omitempty"`
+	Wait            *bool              `json:"wait,omitempty"`
+	Timeout         int                `json:"timeout,omitempty"` // seconds
+	Atomic          *bool              `json:"atomic,omitempty"`
+	CreateNamespace *bool              `json:"createNamespace,omitempty"`
+}
+
+// helmfile is the subset of the helmfile format the wrapper reads and
+// writes, templates and environments are not supported.
+type helmfile struct {
+	Repositories []helmfileRepository `json:"repositories,omitempty"`
+	HelmDefaults *helmfileDefaults    `json:"helmDefaults,omitempty"`
+	Releases     []helmfileRelease    `json:"releases"`
+}
+
+func boolValue(b *bool, def bool) bool {
+	if b == nil {
+		return def
+	}
+
+	return *b
+}
+
+// helmfileChart resolves the chart of a helmfile release to a chart
+// reference of the wrapper.
+func helmfileChart(chart string, repositories map[string]helmfileRepository) (string, string, error) {
+	if strings.HasPrefix(chart, "oci://") {
+		return chart, "", nil
+	}
+	parts := strings.SplitN(chart, "/", 2)
+	if len(parts) != 2 || parts[0] == "." || parts[0] == ".." || parts[0] == "" {
+		return "", "", fmt.Errorf("local chart %s is not supported", chart)
+	}
+	for _, re := range helmConfig.HelmRepos {
+		if re.Name == parts[0] {
+			return chart, "", nil
+		}
+	}
+	for _, re := range helmConfig.HelmRegistries {
+		if re.Name == parts[0] {
+			return strings.TrimSuffix(re.URL, "/") + "/" + parts[1], "", nil
+		}
+	}
+	r, ok := repositories[parts[0]]
+	if !ok {
+		return "", "", fmt.Errorf("repository of chart %s is not defined", chart)
+	}
+	if r.OCI {
+		return "oci://" + strings.TrimSuffix(strings.TrimPrefix(r.URL, "oci://"), "/") + "/" + parts[1], "", nil
+	}
+
+	// charts of other repositories are located with --repo
+	return parts[1], r.URL, nil
+}
+
+// helmfileValues merges the inline values and the set values of a helmfile
+// release, later values override earlier ones and set values override
+// values. Names of set values are keys as of --set, their values are kept as
+// they are, so maps, lists and strings with commas or dots stay intact.
+func helmfileValues(values []interface{}, set []helmfileSetValue) (map[string]interface{}, error) {
+	merged := map[string]interface{}{}
+	for _, v := range values {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("values file %v is not supported, inline the values", v)
+		}
+		merged = chartutil.MergeTables(m, merged)
+	}
+	for _, s := range set {
+		data, err := json.Marshal(s.Value)
+		if err != nil {
+			return nil, err
+		}
+		if err := strvals.ParseJSON(s.Name+"="+string(data), merged); err != nil {
+			return nil, fmt.Errorf("failed parsing set value %s: %s", s.Name, err)
+		}
+	}
+
+	return merged, nil
+}
+
+// importHelmfile converts a helmfile into a desired state.
+func importHelmfile(data []byte) (*desiredState, error) {
+	var hf helmfile
+	err := yaml.Unmarshal(data, &hf)
+	if err != nil {
+		return nil, fmt.Errorf("failed parsing helmfile: %s", err)
+	}
+	defaults := hf.HelmDefaults
+	if defaults == nil {
+		defaults = &helmfileDefaults{}
+	}
+	repositories := map[string]helmfileRepository{}
+	for _, r := range hf.Repositories {
+		repositories[r.Name] = r
+	}
+
+	state := &desiredState{}
+	for _, hr := range hf.Releases {
+		r := &desiredRelease{
+			Name:      hr.Name,
+			Namespace: hr.Namespace,
+			Needs:     hr.Needs,
+			Absent:    !boolValue(hr.Installed, true),
+		}
+		if r.Namespace == "" {
+			r.Namespace = "default"
+		}
+		r.KubeContext = hr.KubeContext
+		if r.KubeContext == "" {
+			r.KubeContext = defaults.KubeContext
+		}
+		if !r.Absent {
+			r.Chart, r.RepoURL, err = helmfileChart(hr.Chart, repositories)
+			if err != nil {
+				return nil, fmt.Errorf("release %s: %s", hr.Name, err)
+			}
+		}
+		r.Version = hr.Version
+		vals, err := helmfileValues(hr.Values, hr.Set)
+		if err != nil {
+			return nil, fmt.Errorf("release %s: %s", hr.Name, err)
+		}
+		if len(vals) > 0 {
+			r.Values = vals
+		}
+		r.Wait = boolValue(hr.Wait, defaults.Wait)
+		r.Atomic = boolValue(hr.Atomic, defaults.Atomic)
+		r.CreateNamespace = boolValue(hr.CreateNamespace, boolValue(defaults.CreateNamespace, true))
+		timeout := hr.Timeout
+		if timeout == 0 {
+			timeout = defaults.Timeout
+		}
+		if timeout > 0 {
+			r.Timeout = fmt.Sprintf("%ds", timeout)
+		}
+		state.Releases = append(state.Releases, r)
+	}
+
+	return state, nil
+}
+
+// helmfileRegistries looks up deployed charts in the configured registries
+// during one export. The tags of a chart are listed once per registry, and
+// a registry which could not be searched is not asked again.
+type helmfileRegistries struct {
+	tags   map[string][]string // by registry URL and chart name
+	failed map[string]bool     // by registry name
+	errs   []string
+}
+
+func newHelmfileRegistries() *helmfileRegistries {
+	return &helmfileRegistries{
+		tags:   map[string][]string{},
+		failed: map[string]bool{},
+	}
+}
+
+// registryNotFound reports whether a registry has no repository of a chart.
+// The registry client formats the status code into the error.
+func registryNotFound(err error) bool {
+	return strings.Contains(err.Error(), "status code 404")
+}
+
+// registryOf finds a deployed chart in the configured registries, they are
+// written as OCI repositories.
+func (r *helmfileRegistries) registryOf(name, version string) (helmfileRepository, bool) {
+	for _, re := range helmConfig.HelmRegistries {
+		if r.failed[re.Name] {
+			continue
+		}
+		url := strings.TrimSuffix(strings.TrimPrefix(re.URL, "oci://"), "/")
+		ref := url + "/" + name
+		tags, ok := r.tags[ref]
+		if !ok {
+			registryClient, err := ociRegistries.client(&RegistryConfig{Host: strings.SplitN(url, "/", 2)[0]})
+			if err == nil {
+				tags, err = registryClient.Tags(ref)
+			}
+			if err != nil && !registryNotFound(err) {
+				r.failed[re.Name] = true
+				r.errs = append(r.errs, fmt.Sprintf("registry %s (%s) could not be searched: %s", re.Name, url, err))
+				continue
+			}
+			r.tags[ref] = tags
+		}
+		for _, tag := range tags {
+			if tag == version {
+				return helmfileRepository{Name: re.Name, URL: url, OCI: true}, true
+			}
+		}
+	}
+
+	return helmfileRepository{}, false
+}
+
+// repositoryOf finds the repository of a deployed chart, a configured
+// repository, the chart repository of uploaded charts or a configured
+// registry.
+func (r *helmfileRegistries) repositoryOf(name, version, uploadRepoURL string) (helmfileRepository, bool) {
+	for _, re := range helmConfig.HelmRepos {
+		f := filepath.Join(settings.RepositoryCache, helmpath.CacheIndexFile(re.Name))
+		ind, err := repo.LoadIndexFile(f)
+		if err != nil {
+			continue
+		}
+		if _, err := ind.Get(name, version); err == nil {
+			return helmfileRepository{Name: re.Name, URL: re.URL}, true
+		}
+	}
+	if _, ok := uploadRepoIndex.get(name, version); ok {
+		return helmfileRepository{Name: uploadRepoName, URL: uploadRepoURL}, true
+	}
+
+	return r.registryOf(name, version)
+}
+
+// exportHelmfile describes releases as a helmfile. Charts which are not
+// found in a repository are written by name, the registries which could not
+// be searched are returned.
+func exportHelmfile(releases []*release.Release, kubeContext, uploadRepoURL string) (*helmfile, []string) {
+	hf := &helmfile{Releases: []helmfileRelease{}}
+	registries := newHelmfileRegistries()
+	repositories := map[string]bool{}
+	for _, rls := range releases {
+		md := rls.Chart.Metadata
+		hr := helmfileRelease{
+			Name:        rls.Name,
+			Namespace:   rls.Namespace,
+			Chart:       md.Name,
+			Version:     md.Version,
+			KubeContext: kubeContext,
+		}
+		if r, ok := registries.repositoryOf(md.Name, md.Version, uploadRepoURL); ok {
+			hr.Chart = r.Name + "/" + md.Name
+			if !repositories[r.Name] {
+				repositories[r.Name] = true
+				hf.Repositories = append(hf.Repositories, r)
+			}
+		}
+		if len(rls.Config) > 0 {
+			hr.Values = []interface{}{rls.Config}
+		}
+		hf.Releases = append(hf.Releases, hr)
+	}
+
+	return hf, registries.errs
+}
+
+// exportNamespaceHelmfile exports the deployed releases of a namespace as a
+// helmfile.
+func exportNamespaceHelmfile(c *gin.Context) {
+	namespace := c.Param("namespace")
+
+	actionConfig, err := actionConfigInit(kubeInformation(c, namespace))
+	if err != nil {
+		respErr(c, err)
+		return
+	}
+	client := action.NewList(actionConfig)
+	client.Deployed = true
+	client.SetStateMask()
+	results, err := client.Run()
+	if err != nil {
+		respErr(c, err)
+		return
+	}
+
+	scheme := "http"
+	if c.Request.TLS != nil {
+		scheme = "https"
+	}
+	hf, errs := exportHelmfile(results, c.Query("kube_context"), scheme+"://"+c.Request.Host)
+	data, err := yaml.Marshal(hf)
+	if err != nil {
+		respErr(c, err)
+		return
+	}
+	// charts of the registries which could not be searched may be written
+	// by name, say so on top of the helmfile
+	var header strings.Builder
+	for _, e := range errs {
+		glog.Warningf("export helmfile of %s: %s", namespace, e)
+		header.WriteString("# " + strings.ReplaceAll(e, "\n", " ") + "\n")
+	}
+	data = append([]byte(header.String()), data...)
+
+	c.Data(http.StatusOK, "application/x-yaml", data)
+}
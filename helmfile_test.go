@@ -0,0 +1,189 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/release"
+	"helm.sh/helm/v3/pkg/repo"
+)
+
+func TestImportHelmfileValues(t *testing.T) {
+	tests := []struct {
+		name     string
+		helmfile string
+		want     map[string]interface{}
+	}{
+		{
+			name: "values and set",
+			helmfile: `
+releases:
+- name: web
+  chart: oci://registry.example.com/charts/nginx
+  values:
+  - replicaCount: 1
+    service: {type: ClusterIP, port: 80}
+  - replicaCount: 2
+  set:
+  - name: service.type
+    value: NodePort
+`,
+			want: map[string]interface{}{
+				"replicaCount": float64(2),
+				"service":      map[string]interface{}{"type": "NodePort", "port": float64(80)},
+			},
+		},
+		{
+			name: "set maps and lists",
+			helmfile: `
+releases:
+- name: web
+  chart: oci://registry.example.com/charts/nginx
+  set:
+  - name: resources
+    value: {limits: {cpu: 100m}}
+  - name: args
+    value: [--verbose, --port=80]
+  - name: ports[1]
+    value: 443
+`,
+			want: map[string]interface{}{
+				"resources": map[string]interface{}{"limits": map[string]interface{}{"cpu": "100m"}},
+				"args":      []interface{}{"--verbose", "--port=80"},
+				"ports":     []interface{}{nil, float64(443)},
+			},
+		},
+		{
+			name: "set strings with commas, dots and equal signs",
+			helmfile: `
+releases:
+- name: web
+  chart: oci://registry.example.com/charts/nginx
+  set:
+  - name: hosts
+    value: a.example.com,b.example.com
+  - name: podAnnotations.prometheus\.io/scrape
+    value: "true"
+  - name: env.OPTS
+    value: -Dkey=value
+`,
+			want: map[string]interface{}{
+				"hosts":          "a.example.com,b.example.com",
+				"podAnnotations": map[string]interface{}{"prometheus.io/scrape": "true"},
+				"env":            map[string]interface{}{"OPTS": "-Dkey=value"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state, err := importHelmfile([]byte(tt.helmfile))
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := state.Releases[0]
+			if err := r.bindValues(); err != nil {
+				t.Fatal(err)
+			}
+			got, err := desiredValues(r.releaseOptions)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got values %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestImportHelmfileOCIRepository(t *testing.T) {
+	state, err := importHelmfile([]byte(`
+repositories:
+- name: charts
+  url: registry.example.com/charts
+  oci: true
+releases:
+- name: web
+  chart: charts/nginx
+  version: 15.0.0
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := state.Releases[0].Chart; got != "oci://registry.example.com/charts/nginx" {
+		t.Errorf("got chart %s, want oci://registry.example.com/charts/nginx", got)
+	}
+}
+
+func TestExportHelmfileOCIRepository(t *testing.T) {
+	router := setupRegistryTest(t)
+	host := newTestRegistry(t, false)
+	ociRegistries.configs[host] = &RegistryConfig{Host: host, PlainHTTP: true}
+	resp := doRegistryRequest(t, router, http.MethodPost, "/api/registries/charts/push", registryPushOptions{
+		Chart:  saveTestChart(t, "mychart", "0.1.0"),
+		Remote: "oci://" + host + "/charts",
+	})
+	if resp.Code != 0 {
+		t.Fatalf("push: %s", resp.Error)
+	}
+
+	registries := helmConfig.HelmRegistries
+	// nothing listens on port 1
+	helmConfig.HelmRegistries = []*repo.Entry{
+		{Name: "down", URL: "oci://127.0.0.1:1/charts"},
+		{Name: "charts", URL: "oci://" + host + "/charts"},
+	}
+	index := uploadRepoIndex
+	uploadRepoIndex = &chartRepoIndex{index: repo.NewIndexFile(), updated: time.Now()}
+	t.Cleanup(func() {
+		helmConfig.HelmRegistries = registries
+		uploadRepoIndex = index
+	})
+
+	hf, errs := exportHelmfile([]*release.Release{
+		{Name: "web", Namespace: "shop", Chart: &chart.Chart{Metadata: &chart.Metadata{Name: "mychart", Version: "0.1.0"}}},
+		{Name: "db", Namespace: "shop", Chart: &chart.Chart{Metadata: &chart.Metadata{Name: "mychart", Version: "9.9.9"}}},
+		{Name: "mq", Namespace: "shop", Chart: &chart.Chart{Metadata: &chart.Metadata{Name: "rabbitmq", Version: "1.0.0"}}},
+	}, "", "http://helm-wrapper")
+
+	// the unreachable registry is reported once, a chart missing from a
+	// registry is not an error
+	if len(errs) != 1 || !strings.Contains(errs[0], "registry down (127.0.0.1:1/charts) could not be searched") {
+		t.Errorf("got errors %q, want the unreachable registry down", errs)
+	}
+
+	want := []helmfileRepository{{Name: "charts", URL: host + "/charts", OCI: true}}
+	if !reflect.DeepEqual(hf.Repositories, want) {
+		t.Errorf("got repositories %+v, want %+v", hf.Repositories, want)
+	}
+	if got := hf.Releases[0].Chart; got != "charts/mychart" {
+		t.Errorf("got chart %s, want charts/mychart", got)
+	}
+	if got := hf.Releases[1].Chart; got != "mychart" {
+		t.Errorf("got chart of a version not in the registry %s, want mychart", got)
+	}
+	if got := hf.Releases[2].Chart; got != "rabbitmq" {
+		t.Errorf("got chart not in the registry %s, want rabbitmq", got)
+	}
+
+	// the export imports the chart from the registry again
+	state, err := importHelmfile([]byte(`
+repositories:
+- name: charts
+  url: ` + host + `/charts
+  oci: true
+releases:
+- name: web
+  chart: charts/mychart
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := state.Releases[0].Chart; got != "oci://"+host+"/charts/mychart" {
+		t.Errorf("got chart %s, want oci://%s/charts/mychart", got, host)
+	}
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/distribution/reference"
+	"github.com/gin-gonic/gin"
+	"github.com/golang/glog"
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/release"
+	"helm.sh/helm/v3/pkg/releaseutil"
+	"sigs.k8s.io/yaml"
+)
+
+var containerFields = map[string]string{
+	"containers":          "container",
+	"initContainers":      "initContainer",
+	"ephemeralContainers": "ephemeralContainer",
+}
+
+type containerImage struct {
+	Image      string `json:"image"`
+	Repository string `json:"repository"`
+	Tag        string `json:"tag,omitempty"`
+	Digest     string `json:"digest,omitempty"`
+	Resource   string `json:"resource"` // <kind>/<name>
+	Container  string `json:"container"`
+	Type       string `json:"type"` // container, initContainer or ephemeralContainer
+}
+
+type releaseImages struct {
+	Namespace string           `json:"namespace"`
+	Release   string           `json:"release"`
+	Chart     string           `json:"chart"`
+	Images    []containerImage `json:"images"`
+}
+
+type imageTagUsage struct {
+	Tag      string   `json:"tag"` // tag or digest
+	Releases []string `json:"releases"`
+}
+
+type imageUsage struct {
+	Repository string           `json:"repository"`
+	Tags       []*imageTagUsage `json:"tags"`
+}
+
+// parseImage splits an image reference into its normalized repository, tag
+// and digest. References that do not parse, e.g. templated ones, are kept
+// as they are.
+func parseImage(image string) (repository, tag, digest string) {
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return image, "", ""
+	}
+	if tagged, ok := named.(reference.Tagged); ok {
+		tag = tagged.Tag()
+	}
+	if digested, ok := named.(reference.Digested); ok {
+		digest = digested.Digest().String()
+	}
+	if tag == "" && digest == "" {
+		tag = "latest"
+	}
+
+	return named.Name(), tag, digest
+}
+
+// findContainerImages walks a manifest object and collects the images of all
+// container lists, so pods, workloads, cronjobs and custom resources
+// embedding pod templates are all covered.
+func findContainerImages(obj interface{}, resource string, images []containerImage) []containerImage {
+	switch v := obj.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			typ, ok := containerFields[key]
+			list, isList := value.([]interface{})
+			if !ok || !isList {
+				images = findContainerImages(value, resource, images)
+				continue
+			}
+			for _, item := range list {
+				container, _ := item.(map[string]interface{})
+				image, _ := container["image"].(string)
+				if image == "" {
+					continue
+				}
+				name, _ := container["name"].(string)
+				repository, tag, digest := parseImage(image)
+				images = append(images, containerImage{
+					Image:      image,
+					Repository: repository,
+					Tag:        tag,
+					Digest:     digest,
+					Resource:   resource,
+					Container:  name,
+					Type:       typ,
+				})
+			}
+		}
+	case []interface{}:
+		for _, item := range v {
+			images = findContainerImages(item, resource, images)
+		}
+	}
+
+	return images
+}
+
+// manifestImages returns the container images of a rendered manifest.
+func manifestImages(manifest string) ([]containerImage, error) {
+	images := []containerImage{}
+	manifests := releaseutil.SplitManifests(manifest)
+	keys := make([]string, 0, len(manifests))
+	for k := range manifests {
+		keys = append(keys, k)
+	}
+	sort.Sort(releaseutil.BySplitManifestsOrder(keys))
+
+	for _, k := range keys {
+		var obj map[string]interface{}
+		err := yaml.Unmarshal([]byte(manifests[k]), &obj)
+		if err != nil {
+			return nil, fmt.Errorf("failed parsing manifest: %s", err)
+		}
+		if obj == nil {
+			continue
+		}
+		kind, _ := obj["kind"].(string)
+		var name string
+		if metadata, ok := obj["metadata"].(map[string]interface{}); ok {
+			name, _ = metadata["name"].(string)
+		}
+		images = findContainerImages(obj, kind+"/"+name, images)
+	}
+
+	return images, nil
+}
+
+// releaseManifest returns the manifest of a release including its hooks.
+func releaseManifest(rls *release.Release) string {
+	var sb strings.Builder
+	sb.WriteString(rls.Manifest)
+	for _, hook := range rls.Hooks {
+		sb.WriteString("\n---\n")
+		sb.WriteString(hook.Manifest)
+	}
+
+	return sb.String()
+}
+
+func getReleaseImages(rls *release.Release) (*releaseImages, error) {
+	images, err := manifestImages(releaseManifest(rls))
+	if err != nil {
+		return nil, err
+	}
+
+	return &releaseImages{
+		Namespace: rls.Namespace,
+		Release:   rls.Name,
+		Chart:     formatChartname(rls.Chart),
+		Images:    images,
+	}, nil
+}
+
+// renderChart renders a chart with the given values without contacting a
+// cluster, like helm template.
+func renderChart(name, namespace, aimChart string, options releaseOptions) (*release.Release, error) {
+	vals, err := mergeValues(options)
+	if err != nil {
+		return nil, err
+	}
+	chrt, err := loadChartWithOptions(aimChart, options.ChartPathOptions)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := isChartInstallable(chrt); err != nil {
+		return nil, err
+	}
+	if req := chrt.Metadata.Dependencies; req != nil {
+		if err := action.CheckDependencies(chrt, req); err != nil {
+			return nil, err
+		}
+	}
+
+	client := action.NewInstall(&action.Configuration{Log: glog.Infof})
+	client.ReleaseName = name
+	client.Namespace = namespace
+	client.DryRun = true
+	client.ClientOnly = true
+	client.Replace = true
+
+	return client.Run(chrt, vals)
+}
+
+func listChartImages(c *gin.Context) {
+	aimChart := c.Query("chart")
+	if aimChart == "" {
+		respErr(c, fmt.Errorf("chart name can not be empty"))
+		return
+	}
+	name := c.Query("release")
+	if name == "" {
+		name = "release-name"
+	}
+	namespace := c.Query("namespace")
+	if namespace == "" {
+		namespace = "default"
+	}
+
+	var options releaseOptions
+	err := c.ShouldBindJSON(&options)
+	if err != nil && err != io.EOF {
+		respErr(c, err)
+		return
+	}
+	if version := c.Query("version"); version != "" {
+		options.Version = version
+	}
+
+	rls, err := renderChart(name, namespace, aimChart, options)
+	if err != nil {
+		respErr(c, err)
+		return
+	}
+	images, err := getReleaseImages(rls)
+	if err != nil {
+		respErr(c, err)
+		return
+	}
+
+	respOK(c, images)
+}
+
+func listReleaseImages(c *gin.Context) {
+	name := c.Param("release")
+	namespace := c.Param("namespace")
+
+	actionConfig, err := actionConfigInit(kubeInformation(c, namespace))
+	if err != nil {
+		respErr(c, err)
+		return
+	}
+
+	client := action.NewGet(actionConfig)
+	rls, err := client.Run(name)
+	if err != nil {
+		respErr(c, err)
+		return
+	}
+	images, err := getReleaseImages(rls)
+	if err != nil {
+		respErr(c, err)
+		return
+	}
+
+	respOK(c, images)
+}
+
+// aggregateImages groups the images of releases by repository and tag.
+func aggregateImages(releases []*releaseImages) []*imageUsage {
+	usages := map[string]*imageUsage{}
+	tags := map[string]*imageTagUsage{}
+	seen := map[string]bool{}
+	for _, rls := range releases {
+		releaseName := rls.Namespace + "/" + rls.Release
+		for _, image := range rls.Images {
+			tag := image.Tag
+			if image.Digest != "" {
+				tag = image.Digest
+			}
+			tagKey := image.Repository + "\x00" + tag
+			if seen[tagKey+"\x00"+releaseName] {
+				continue
+			}
+			seen[tagKey+"\x00"+releaseName] = true
+
+			usage, ok := usages[image.Repository]
+			if !ok {
+				usage = &imageUsage{Repository: image.Repository}
+				usages[image.Repository] = usage
+			}
+			tagUsage, ok := tags[tagKey]
+			if !ok {
+				tagUsage = &imageTagUsage{Tag: tag}
+				tags[tagKey] = tagUsage
+				usage.Tags = append(usage.Tags, tagUsage)
+			}
+			tagUsage.Releases = append(tagUsage.Releases, releaseName)
+		}
+	}
+
+	result := make([]*imageUsage, 0, len(usages))
+	for _, usage := range usages {
+		sort.Slice(usage.Tags, func(i, j int) bool {
+			return usage.Tags[i].Tag < usage.Tags[j].Tag
+		})
+		for _, tag := range usage.Tags {
+			sort.Strings(tag.Releases)
+		}
+		result = append(result, usage)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Repository < result[j].Repository
+	})
+
+	return result
+}
+
+// listNamespaceImages aggregates the images of the deployed releases of a
+// namespace, or of the whole cluster with all_namespaces=true.
+func listNamespaceImages(c *gin.Context) {
+	namespace := c.Param("namespace")
+	allNamespaces := c.Query("all_namespaces") == "true"
+	if allNamespaces {
+		namespace = ""
+	}
+
+	actionConfig, err := actionConfigInit(kubeInformation(c, namespace))
+	if err != nil {
+		respErr(c, err)
+		return
+	}
+
+	client := action.NewList(actionConfig)
+	client.AllNamespaces = allNamespaces
+	client.Deployed = true
+	client.SetStateMask()
+	results, err := client.Run()
+	if err != nil {
+		respErr(c, err)
+		return
+	}
+
+	releases := make([]*releaseImages, 0, len(results))
+	for _, rls := range results {
+		images, err := getReleaseImages(rls)
+		if err != nil {
+			respErr(c, fmt.Errorf("release %s/%s: %s", rls.Namespace, rls.Name, err))
+			return
+		}
+		releases = append(releases, images)
+	}
+
+	respOK(c, aggregateImages(releases))
+}
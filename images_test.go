@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestChartImagesWithRequestCredentials(t *testing.T) {
+	router := setupRegistryTest(t)
+	host := newTestRegistry(t, true)
+	resp := doRegistryRequest(t, router, http.MethodPost, "/api/registries/login", &RegistryConfig{
+		Host:      host,
+		Username:  testRegistryUsername,
+		Password:  testRegistryPassword,
+		PlainHTTP: true,
+	})
+	if resp.Code != 0 {
+		t.Fatalf("login: %s", resp.Error)
+	}
+	resp = doRegistryRequest(t, router, http.MethodPost, "/api/registries/charts/push", registryPushOptions{
+		Chart:  saveTestChart(t, "mychart", "0.1.0"),
+		Remote: "oci://" + host + "/charts",
+	})
+	if resp.Code != 0 {
+		t.Fatalf("push: %s", resp.Error)
+	}
+	resp = doRegistryRequest(t, router, http.MethodDelete, "/api/registries/login?host="+host, nil)
+	if resp.Code != 0 {
+		t.Fatalf("logout: %s", resp.Error)
+	}
+	// the host stays known without credentials
+	ociRegistries.configs[host] = &RegistryConfig{Host: host, PlainHTTP: true}
+
+	path := "/api/charts/images?chart=oci://" + host + "/charts/mychart&version=0.1.0"
+	resp = doRegistryRequest(t, router, http.MethodPost, path, nil)
+	if resp.Code == 0 {
+		t.Error("images without credentials: expected an error")
+	}
+	resp = doRegistryRequest(t, router, http.MethodPost, path, &ChartPathOptions{
+		Username: testRegistryUsername,
+		Password: testRegistryPassword,
+	})
+	if resp.Code != 0 {
+		t.Errorf("images with request credentials: %s", resp.Error)
+	}
+}
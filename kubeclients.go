@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/cli-runtime/pkg/genericclioptions"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+const defaultKubeClientCacheTTL = 5 * time.Minute
+
+type kubeClientKey struct {
+	kubeConfig        string
+	kubeContext       string
+	namespace         string
+	cluster           string
+	impersonate       string
+	impersonateGroups string
+	timeout           time.Duration
+}
+
+// kubeClientEntry holds the clients of a target. The capabilities of the
+// cluster are not cached, helm discovers them for every action so charts see
+// CRDs and APIs installed since.
+type kubeClientEntry struct {
+	getter  genericclioptions.RESTClientGetter
+	expires time.Time
+	// modification time of the kubeconfig files, a change rebuilds the
+	// clients
+	modified string
+}
+
+// kubeClientCache keeps the kube clients of a cluster and namespace with
+// their discovery client and REST mapper, so requests do not load the
+// kubeconfig and build the clients again.
+type kubeClientCache struct {
+	sync.Mutex
+	ttl     time.Duration
+	entries map[kubeClientKey]*kubeClientEntry
+}
+
+var kubeClients = &kubeClientCache{
+	ttl:     defaultKubeClientCacheTTL,
+	entries: map[kubeClientKey]*kubeClientEntry{},
+}
+
+// initKubeClientCache sets the TTL of the cache, 0 disables it.
+func initKubeClientCache(ttl string) error {
+	if ttl == "" {
+		return nil
+	}
+	d, err := time.ParseDuration(ttl)
+	if err != nil {
+		return fmt.Errorf("invalid kube client cache ttl %s: %s", ttl, err)
+	}
+	kubeClients.ttl = d
+
+	return nil
+}
+
+func newKubeClientKey(kubeInfo *KubeInformation) kubeClientKey {
+	return kubeClientKey{
+		kubeConfig:        kubeInfo.AimConfig,
+		kubeContext:       kubeInfo.AimContext,
+		namespace:         kubeInfo.AimNamespace,
+		cluster:           kubeInfo.AimCluster,
+		impersonate:       kubeInfo.AimImpersonate,
+		impersonateGroups: strings.Join(kubeInfo.AimImpersonateGroups, ","),
+		timeout:           kubeInfo.AimTimeout,
+	}
+}
+
+// kubeConfigModified returns the modification times of the kubeconfig files
+// of a target, registered clusters are invalidated when they change.
+func kubeConfigModified(kubeInfo *KubeInformation) string {
+	if kubeInfo.AimCluster != "" {
+		return ""
+	}
+
+	var files []string
+	if kubeInfo.AimConfig != "" {
+		files = []string{kubeInfo.AimConfig}
+	} else if settings.KubeConfig != "" {
+		files = []string{settings.KubeConfig}
+	} else {
+		files = clientcmd.NewDefaultClientConfigLoadingRules().Precedence
+	}
+
+	var modified []string
+	for _, f := range files {
+		if info, err := os.Stat(f); err == nil {
+			modified = append(modified, info.ModTime().String())
+		}
+	}
+
+	return strings.Join(modified, ",")
+}
+
+func (c *kubeClientCache) get(kubeInfo *KubeInformation) (*kubeClientEntry, error) {
+	if c.ttl <= 0 {
+		getter, err := newRESTClientGetter(kubeInfo)
+		if err != nil {
+			return nil, err
+		}
+		return &kubeClientEntry{getter: getter}, nil
+	}
+
+	key := newKubeClientKey(kubeInfo)
+	modified := kubeConfigModified(kubeInfo)
+	now := time.Now()
+
+	c.Lock()
+	entry, ok := c.entries[key]
+	c.Unlock()
+	if ok && now.Before(entry.expires) && entry.modified == modified {
+		return entry, nil
+	}
+
+	getter, err := newRESTClientGetter(kubeInfo)
+	if err != nil {
+		return nil, err
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	for k, e := range c.entries {
+		if now.After(e.expires) {
+			delete(c.entries, k)
+		}
+	}
+	entry = &kubeClientEntry{
+		getter:   getter,
+		expires:  now.Add(c.ttl),
+		modified: modified,
+	}
+	c.entries[key] = entry
+
+	return entry, nil
+}
+
+// invalidateCluster drops the clients of a registered cluster, after its
+// credentials changed or it was removed.
+func (c *kubeClientCache) invalidateCluster(cluster string) {
+	c.Lock()
+	defer c.Unlock()
+	for k := range c.entries {
+		if k.cluster == cluster {
+			delete(c.entries, k)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const benchKubeConfig = `apiVersion: v1
+kind: Config
+clusters:
+- name: bench
+  cluster:
+    server: https://127.0.0.1:6443
+    insecure-skip-tls-verify: true
+contexts:
+- name: bench
+  context:
+    cluster: bench
+    user: bench
+    namespace: default
+current-context: bench
+users:
+- name: bench
+  user:
+    token: bench
+`
+
+// initActionConfig initializes an action config and the clients a request
+// builds from it, without contacting the cluster.
+func initActionConfig(b *testing.B) {
+	actionConfig, err := actionConfigInit(&KubeInformation{AimNamespace: "default"})
+	if err != nil {
+		b.Fatal(err)
+	}
+	if _, err := actionConfig.RESTClientGetter.ToRESTConfig(); err != nil {
+		b.Fatal(err)
+	}
+	if _, err := actionConfig.RESTClientGetter.ToDiscoveryClient(); err != nil {
+		b.Fatal(err)
+	}
+	if _, err := actionConfig.RESTClientGetter.ToRESTMapper(); err != nil {
+		b.Fatal(err)
+	}
+}
+
+func BenchmarkActionConfigInit(b *testing.B) {
+	kubeConfig := filepath.Join(b.TempDir(), "config")
+	if err := os.WriteFile(kubeConfig, []byte(benchKubeConfig), 0600); err != nil {
+		b.Fatal(err)
+	}
+	defaultKubeConfig := settings.KubeConfig
+	settings.KubeConfig = kubeConfig
+	defer func() { settings.KubeConfig = defaultKubeConfig }()
+
+	benchmarks := []struct {
+		name string
+		warm bool
+	}{
+		{name: "cold cache"},
+		{name: "warm cache", warm: true},
+	}
+	for _, bm := range benchmarks {
+		b.Run(bm.name, func(b *testing.B) {
+			kubeClients = &kubeClientCache{
+				ttl:     defaultKubeClientCacheTTL,
+				entries: map[kubeClientKey]*kubeClientEntry{},
+			}
+			if bm.warm {
+				initActionConfig(b)
+			}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if !bm.warm {
+					b.StopTimer()
+					kubeClients.entries = map[kubeClientKey]*kubeClientEntry{}
+					b.StartTimer()
+				}
+				initActionConfig(b)
+			}
+		})
+	}
+}
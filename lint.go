@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/lint/support"
+)
+
+var lintSeverityNames = map[int]string{
+	support.UnknownSev: "UNKNOWN",
+	support.InfoSev:    "INFO",
+	support.WarningSev: "WARNING",
+	support.ErrorSev:   "ERROR",
+}
+
+type chartLintMessage struct {
+	Severity string `json:"severity"`
+	Path     string `json:"path"`
+	Message  string `json:"message"`
+}
+
+// chartLintError is returned when a chart does not pass helm lint, it
+// carries all lint messages of the run.
+type chartLintError struct {
+	Messages []chartLintMessage
+	Errors   []error
+}
+
+func (e *chartLintError) Error() string {
+	errs := make([]string, 0, len(e.Errors))
+	for _, err := range e.Errors {
+		errs = append(errs, err.Error())
+	}
+
+	return fmt.Sprintf("chart lint failed: %s", strings.Join(errs, "; "))
+}
+
+// lintChartArchive runs helm lint against a packaged chart. In strict mode
+// warnings fail the lint as well.
+func lintChartArchive(data []byte, strict bool) ([]chartLintMessage, error) {
+	f, err := os.CreateTemp("", "helm-wrapper-lint-*.tgz")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(data)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	client := action.NewLint()
+	client.Strict = strict
+	client.Namespace = settings.Namespace()
+	result := client.Run([]string{f.Name()}, map[string]interface{}{})
+
+	messages := make([]chartLintMessage, 0, len(result.Messages))
+	for _, m := range result.Messages {
+		messages = append(messages, chartLintMessage{
+			Severity: lintSeverityNames[m.Severity],
+			Path:     m.Path,
+			Message:  m.Err.Error(),
+		})
+	}
+	if len(result.Errors) > 0 {
+		return messages, &chartLintError{
+			Messages: messages,
+			Errors:   result.Errors,
+		}
+	}
+
+	return messages, nil
+}
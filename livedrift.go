@@ -0,0 +1,376 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang/glog"
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/release"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+const (
+	objectInSync  = "in_sync"
+	objectDrifted = "drifted"
+	objectMissing = "missing"
+)
+
+// ignoredLiveFields are populated by the api server, they are not compared
+// even if a manifest sets them.
+var ignoredLiveFields = map[string]bool{
+	"status":                     true,
+	"metadata.managedFields":     true,
+	"metadata.resourceVersion":   true,
+	"metadata.uid":               true,
+	"metadata.creationTimestamp": true,
+	"metadata.generation":        true,
+	"metadata.selfLink":          true,
+}
+
+type objectDrift struct {
+	Resource  string        `json:"resource"` // <kind>/<name>
+	Namespace string        `json:"namespace,omitempty"`
+	Status    string        `json:"status"` // in_sync, drifted or missing
+	Changes   []chartChange `json:"changes,omitempty"`
+}
+
+type releaseLiveDrift struct {
+	releaseTarget
+	Release  string        `json:"release"`
+	Revision int           `json:"revision"`
+	Drifted  bool          `json:"drifted"`
+	Objects  []objectDrift `json:"objects"`
+	Checked  time.Time     `json:"checked"`
+	Error    string        `json:"error,omitempty"`
+}
+
+// liveValue normalizes numbers, manifests and the api server may decode
+// the same number to different types.
+func liveValue(v interface{}) interface{} {
+	switch n := v.(type) {
+	case int64:
+		return float64(n)
+	case int:
+		return float64(n)
+	case int32:
+		return float64(n)
+	}
+
+	return v
+}
+
+// equalQuantities reports whether two values are the same resource quantity,
+// the api server writes quantities in canonical form, e.g. 1000m as 1.
+func equalQuantities(desired, live interface{}) bool {
+	parse := func(v interface{}) (resource.Quantity, bool) {
+		var s string
+		switch n := liveValue(v).(type) {
+		case string:
+			s = n
+		case float64:
+			s = strconv.FormatFloat(n, 'f', -1, 64)
+		default:
+			return resource.Quantity{}, false
+		}
+		q, err := resource.ParseQuantity(s)
+		return q, err == nil
+	}
+
+	d, ok := parse(desired)
+	if !ok {
+		return false
+	}
+	l, ok := parse(live)
+
+	return ok && d.Cmp(l) == 0
+}
+
+// isEmptyValue reports values the api server drops, an empty field of a
+// manifest is not missing in the live object.
+func isEmptyValue(v interface{}) bool {
+	switch e := v.(type) {
+	case nil:
+		return true
+	case string:
+		return e == ""
+	case map[string]interface{}:
+		return len(e) == 0
+	case []interface{}:
+		return len(e) == 0
+	}
+
+	return false
+}
+
+// diffLiveFields compares the fields set by a manifest with the live
+// object. Fields only set in the live object are defaults or set by
+// controllers and are not reported.
+func diffLiveFields(path string, desired, live interface{}, changes []chartChange) []chartChange {
+	if ignoredLiveFields[path] {
+		return changes
+	}
+
+	switch d := desired.(type) {
+	case map[string]interface{}:
+		l, ok := live.(map[string]interface{})
+		if !ok {
+			return append(changes, chartChange{Path: path, Type: changeChanged, From: desired, To: live})
+		}
+		keys := make([]string, 0, len(d))
+		for k := range d {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			p := k
+			if path != "" {
+				p = path + "." + k
+			}
+			lv, ok := l[k]
+			if !ok {
+				if !isEmptyValue(d[k]) && !ignoredLiveFields[p] {
+					changes = append(changes, chartChange{Path: p, Type: changeRemoved, From: d[k]})
+				}
+				continue
+			}
+			changes = diffLiveFields(p, d[k], lv, changes)
+		}
+	case []interface{}:
+		l, ok := live.([]interface{})
+		if !ok || len(l) != len(d) {
+			return append(changes, chartChange{Path: path, Type: changeChanged, From: desired, To: live})
+		}
+		for i := range d {
+			changes = diffLiveFields(fmt.Sprintf("%s[%d]", path, i), d[i], l[i], changes)
+		}
+	default:
+		if !reflect.DeepEqual(liveValue(desired), liveValue(live)) && !equalQuantities(desired, live) {
+			changes = append(changes, chartChange{Path: path, Type: changeChanged, From: desired, To: live})
+		}
+	}
+
+	return changes
+}
+
+// checkLiveDrift fetches the live objects of the manifest of a release and
+// compares them with the manifest.
+func checkLiveDrift(actionConfig *action.Configuration, rls *release.Release) ([]objectDrift, error) {
+	resources, err := actionConfig.KubeClient.Build(strings.NewReader(rls.Manifest), false)
+	if err != nil {
+		return nil, err
+	}
+
+	objects := []objectDrift{}
+	for _, info := range resources {
+		desired, err := runtime.DefaultUnstructuredConverter.ToUnstructured(info.Object)
+		if err != nil {
+			return nil, err
+		}
+		drift := objectDrift{
+			Resource:  info.Object.GetObjectKind().GroupVersionKind().Kind + "/" + info.Name,
+			Namespace: info.Namespace,
+			Status:    objectInSync,
+		}
+
+		err = info.Get()
+		if apierrors.IsNotFound(err) {
+			drift.Status = objectMissing
+			objects = append(objects, drift)
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to get %s: %s", drift.Resource, err)
+		}
+		live, err := runtime.DefaultUnstructuredConverter.ToUnstructured(info.Object)
+		if err != nil {
+			return nil, err
+		}
+
+		drift.Changes = diffLiveFields("", desired, live, nil)
+		if len(drift.Changes) > 0 {
+			drift.Status = objectDrifted
+		}
+		objects = append(objects, drift)
+	}
+
+	return objects, nil
+}
+
+func newReleaseLiveDrift(target releaseTarget, rls *release.Release, objects []objectDrift, err error) *releaseLiveDrift {
+	drift := &releaseLiveDrift{
+		releaseTarget: target,
+		Release:       rls.Name,
+		Revision:      rls.Version,
+		Objects:       objects,
+		Checked:       time.Now(),
+	}
+	if err != nil {
+		drift.Error = err.Error()
+		return drift
+	}
+	for _, obj := range objects {
+		if obj.Status != objectInSync {
+			drift.Drifted = true
+		}
+	}
+
+	return drift
+}
+
+// liveDriftMonitor checks the deployed releases of all clusters periodically
+// and keeps their latest drift state.
+type liveDriftMonitor struct {
+	sync.Mutex
+	states map[string][]*releaseLiveDrift // by cluster target
+}
+
+var driftMonitor = &liveDriftMonitor{
+	states: map[string][]*releaseLiveDrift{},
+}
+
+// initDriftMonitor starts the periodic drift check, an empty interval
+// disables it.
+func initDriftMonitor(interval string) error {
+	if interval == "" {
+		return nil
+	}
+	d, err := time.ParseDuration(interval)
+	if err != nil {
+		return fmt.Errorf("invalid drift check interval %s: %s", interval, err)
+	}
+	if d <= 0 {
+		return nil
+	}
+
+	go func() {
+		for {
+			driftMonitor.run()
+			time.Sleep(d)
+		}
+	}()
+
+	return nil
+}
+
+func (m *liveDriftMonitor) run() {
+	targets, err := clusterTargets(nil, nil)
+	if err != nil {
+		glog.Warningf("drift check: %s", err)
+		return
+	}
+
+	var wg sync.WaitGroup
+	for _, target := range targets {
+		wg.Add(1)
+		go func(target clusterTarget) {
+			defer wg.Done()
+
+			states, err := m.checkCluster(target)
+			if err != nil {
+				glog.Warningf("drift check of %s: %s", target, err)
+				return
+			}
+			m.Lock()
+			m.states[target.String()] = states
+			m.Unlock()
+		}(target)
+	}
+	wg.Wait()
+}
+
+func (m *liveDriftMonitor) checkCluster(target clusterTarget) ([]*releaseLiveDrift, error) {
+	actionConfig, err := actionConfigInit(target.kubeInformation(""))
+	if err != nil {
+		return nil, err
+	}
+	client := action.NewList(actionConfig)
+	client.AllNamespaces = true
+	client.Deployed = true
+	client.SetStateMask()
+	results, err := client.Run()
+	if err != nil {
+		return nil, err
+	}
+
+	states := make([]*releaseLiveDrift, 0, len(results))
+	for _, rls := range results {
+		rt := releaseTarget{clusterTarget: target, Namespace: rls.Namespace}
+		// the kube client resolves manifests in the namespace of its config
+		actionConfig, err := actionConfigInit(rt.kubeInformation())
+		var objects []objectDrift
+		if err == nil {
+			objects, err = checkLiveDrift(actionConfig, rls)
+		}
+		states = append(states, newReleaseLiveDrift(rt, rls, objects, err))
+	}
+
+	return states, nil
+}
+
+// list returns the latest drift states, optionally only the drifted ones.
+func (m *liveDriftMonitor) list(onlyDrifted bool) []*releaseLiveDrift {
+	m.Lock()
+	defer m.Unlock()
+
+	states := []*releaseLiveDrift{}
+	for _, clusterStates := range m.states {
+		for _, state := range clusterStates {
+			if onlyDrifted && !state.Drifted && state.Error == "" {
+				continue
+			}
+			states = append(states, state)
+		}
+	}
+	sort.Slice(states, func(i, j int) bool {
+		if states[i].releaseTarget.String() != states[j].releaseTarget.String() {
+			return states[i].releaseTarget.String() < states[j].releaseTarget.String()
+		}
+		return states[i].Release < states[j].Release
+	})
+
+	return states
+}
+
+// getReleaseLiveDrift compares the manifest of a release with the live
+// objects of the cluster.
+func getReleaseLiveDrift(c *gin.Context) {
+	name := c.Param("release")
+	namespace := c.Param("namespace")
+	kubeInfo := kubeInformation(c, namespace)
+
+	actionConfig, err := actionConfigInit(kubeInfo)
+	if err != nil {
+		respErr(c, err)
+		return
+	}
+	rls, err := action.NewGet(actionConfig).Run(name)
+	if err != nil {
+		respErr(c, err)
+		return
+	}
+	objects, err := checkLiveDrift(actionConfig, rls)
+	if err != nil {
+		respErr(c, err)
+		return
+	}
+
+	target := releaseTarget{
+		clusterTarget: clusterTarget{Cluster: kubeInfo.AimCluster, KubeContext: kubeInfo.AimContext},
+		Namespace:     namespace,
+	}
+	respOK(c, newReleaseLiveDrift(target, rls, objects, nil))
+}
+
+// listLiveDrift returns the drift states of the periodic drift check.
+func listLiveDrift(c *gin.Context) {
+	respOK(c, driftMonitor.list(c.Query("drifted") == "true"))
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"sigs.k8s.io/yaml"
+)
+
+func TestDiffLiveFields(t *testing.T) {
+	tests := []struct {
+		name    string
+		desired string
+		live    string
+		want    []string
+	}{
+		{
+			name:    "equal",
+			desired: `{spec: {replicas: 2, template: {spec: {containers: [{name: app, image: app:1}]}}}}`,
+			live:    `{spec: {replicas: 2, template: {spec: {containers: [{name: app, image: app:1, imagePullPolicy: IfNotPresent}]}}}}`,
+		},
+		{
+			name:    "canonical quantities",
+			desired: `{resources: {limits: {cpu: 1000m, memory: 1024Mi}, requests: {cpu: 0.5, memory: "1Gi"}}}`,
+			live:    `{resources: {limits: {cpu: "1", memory: 1Gi}, requests: {cpu: 500m, memory: "1Gi"}}}`,
+		},
+		{
+			name:    "changed quantity",
+			desired: `{resources: {limits: {cpu: 1000m}}}`,
+			live:    `{resources: {limits: {cpu: "2"}}}`,
+			want:    []string{"resources.limits.cpu"},
+		},
+		{
+			name:    "empty fields dropped by the api server",
+			desired: `{metadata: {annotations: {}, labels: {app: app}}, spec: {resources: {}, args: [], hostname: ""}}`,
+			live:    `{metadata: {labels: {app: app}}, spec: {}}`,
+		},
+		{
+			name:    "changed and removed",
+			desired: `{spec: {replicas: 2, paused: true, image: app:1}}`,
+			live:    `{spec: {replicas: 3, image: app:1}}`,
+			want:    []string{"spec.paused", "spec.replicas"},
+		},
+		{
+			name:    "strings are not quantities",
+			desired: `{spec: {image: app:1}}`,
+			live:    `{spec: {image: app:2}}`,
+			want:    []string{"spec.image"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var desired, live map[string]interface{}
+			if err := yaml.Unmarshal([]byte(tt.desired), &desired); err != nil {
+				t.Fatal(err)
+			}
+			if err := yaml.Unmarshal([]byte(tt.live), &live); err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, change := range diffLiveFields("", desired, live, nil) {
+				got = append(got, change.Path)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got drift %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
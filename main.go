@@ -20,9 +20,19 @@ import (
 )
 
 type HelmConfig struct {
-	UploadPath     string        `yaml:"uploadPath"`
-	HelmRepos      []*repo.Entry `yaml:"helmRepos"`
-	HelmRegistries []*repo.Entry `yaml:"helmRegistries"`
+	UploadPath     string            `yaml:"uploadPath"`
+	HelmRepos      []*repo.Entry     `yaml:"helmRepos"`
+	HelmRegistries []*repo.Entry     `yaml:"helmRegistries"`
+	Storage        *StorageConfig    `yaml:"storage"`
+	Provenance     *ProvenanceConfig `yaml:"provenance"`
+	Clusters       *ClusterConfig    `yaml:"clusters"`
+	Reconcile      *ReconcileConfig  `yaml:"reconcile"`
+	// KubeClientCacheTTL bounds the reuse of kube clients and discovery
+	// data, default 5m, 0 disables the cache
+	KubeClientCacheTTL string `yaml:"kubeClientCacheTTL"`
+	// DriftCheckInterval is the interval of the periodic check of the
+	// releases against the live objects, empty disables it
+	DriftCheckInterval string `yaml:"driftCheckInterval"`
 }
 
 var (
@@ -79,6 +89,24 @@ func main() {
 		}
 	}
 
+	// init chart storage
+	chartStore, err = newChartStorage(helmConfig.Storage)
+	if err != nil {
+		glog.Fatalln(err)
+	}
+
+	// move charts uploaded by filename into the versioned chart storage
+	err = migrateUploadedCharts()
+	if err != nil {
+		glog.Fatalln(err)
+	}
+
+	// init chart repository index of uploaded charts
+	err = uploadRepoIndex.rebuild()
+	if err != nil {
+		glog.Fatalln(err)
+	}
+
 	// init repo
 	for _, c := range helmConfig.HelmRepos {
 		err = initRepos(c)
@@ -95,6 +123,30 @@ func main() {
 		}
 	}
 
+	// init cache of kube clients
+	err = initKubeClientCache(helmConfig.KubeClientCacheTTL)
+	if err != nil {
+		glog.Fatalln(err)
+	}
+
+	// init registered clusters
+	err = initClusters()
+	if err != nil {
+		glog.Fatalln(err)
+	}
+
+	// init periodic drift check of releases
+	err = initDriftMonitor(helmConfig.DriftCheckInterval)
+	if err != nil {
+		glog.Fatalln(err)
+	}
+
+	// init periodic reconciliation of the release specs directory
+	err = initReconciler()
+	if err != nil {
+		glog.Fatalln(err)
+	}
+
 	// router
 	router := gin.New()
 	router.Use(gin.Recovery())
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+const defaultClusterTimeout = 10 * time.Second
+
+// clusterTarget is a registered cluster or a context of the kubeconfig of
+// helm-wrapper.
+type clusterTarget struct {
+	Cluster     string `json:"cluster,omitempty"`
+	KubeContext string `json:"kube_context,omitempty"`
+}
+
+// releaseTarget is a namespace of a cluster.
+type releaseTarget struct {
+	clusterTarget
+	Namespace string `json:"namespace"`
+}
+
+type clusterError struct {
+	clusterTarget
+	Error string `json:"error"`
+}
+
+type clusterResult struct {
+	target clusterTarget
+	value  interface{}
+	err    error
+}
+
+type clusterReleaseElement struct {
+	clusterTarget
+	releaseElement
+}
+
+type clusterReleaseList struct {
+	Releases    []clusterReleaseElement `json:"releases"`
+	Unreachable []clusterError          `json:"unreachable"`
+}
+
+func (t clusterTarget) String() string {
+	if t.Cluster != "" {
+		return t.Cluster
+	}
+	if t.KubeContext != "" {
+		return "context " + t.KubeContext
+	}
+
+	return "default cluster"
+}
+
+func (t clusterTarget) kubeInformation(namespace string) *KubeInformation {
+	return InitKubeInformation(namespace, t.KubeContext, "", t.Cluster)
+}
+
+func (t releaseTarget) String() string {
+	return t.clusterTarget.String() + "/" + t.Namespace
+}
+
+func (t releaseTarget) kubeInformation() *KubeInformation {
+	return t.clusterTarget.kubeInformation(t.Namespace)
+}
+
+// kubeContexts returns the contexts of the kubeconfig of helm-wrapper.
+func kubeContexts() []string {
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	rules.ExplicitPath = settings.KubeConfig
+	config, err := rules.Load()
+	if err != nil {
+		return nil
+	}
+
+	contexts := make([]string, 0, len(config.Contexts))
+	for name := range config.Contexts {
+		contexts = append(contexts, name)
+	}
+	sort.Strings(contexts)
+
+	return contexts
+}
+
+// clusterTargets returns the requested clusters and contexts, by default all
+// registered clusters and all contexts of the kubeconfig. Without contexts
+// the cluster helm-wrapper runs against is used.
+func clusterTargets(clusters, contexts []string) ([]clusterTarget, error) {
+	var targets []clusterTarget
+	if len(clusters) == 0 && len(contexts) == 0 {
+		for _, record := range managedClusters.list() {
+			targets = append(targets, clusterTarget{Cluster: record.Name})
+		}
+		contexts = kubeContexts()
+		if len(contexts) == 0 {
+			targets = append(targets, clusterTarget{})
+		}
+	}
+
+	for _, name := range clusters {
+		if _, err := managedClusters.registration(name); err != nil {
+			return nil, err
+		}
+		targets = append(targets, clusterTarget{Cluster: name})
+	}
+	for _, name := range contexts {
+		targets = append(targets, clusterTarget{KubeContext: name})
+	}
+
+	return targets, nil
+}
+
+// clusterTimeout reads the per cluster timeout of a fan-out request.
+func clusterTimeout(c *gin.Context) (time.Duration, error) {
+	t := c.Query("timeout")
+	if t == "" {
+		return defaultClusterTimeout, nil
+	}
+	timeout, err := time.ParseDuration(t)
+	if err != nil {
+		return 0, fmt.Errorf("invalid timeout %s: %s", t, err)
+	}
+
+	return timeout, nil
+}
+
+// clusterTargetsFromRequest reads the cluster, kube_context and timeout
+// parameters of a fan-out request.
+func clusterTargetsFromRequest(c *gin.Context) ([]clusterTarget, time.Duration, error) {
+	timeout, err := clusterTimeout(c)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	targets, err := clusterTargets(c.QueryArray("cluster"), c.QueryArray("kube_context"))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return targets, timeout, nil
+}
+
+// fanOutKubeInformation returns the kube information of a fan-out target,
+// its kube clients give up after timeout.
+func fanOutKubeInformation(target releaseTarget, timeout time.Duration) *KubeInformation {
+	kubeInfo := target.kubeInformation()
+	kubeInfo.AimTimeout = timeout
+
+	return kubeInfo
+}
+
+// fanOutClusters runs fn against all targets concurrently, with the index of
+// the target. A target which does not answer within timeout fails, its late
+// result is dropped. fn bounds its kube clients with the timeout, see
+// fanOutKubeInformation, so the requests to a hung cluster end as well.
+func fanOutClusters(targets []clusterTarget, timeout time.Duration, fn func(i int, target clusterTarget) (interface{}, error)) []clusterResult {
+	results := make([]clusterResult, len(targets))
+
+	var wg sync.WaitGroup
+	for i, target := range targets {
+		wg.Add(1)
+		go func(i int, target clusterTarget) {
+			defer wg.Done()
+
+			done := make(chan clusterResult, 1)
+			go func() {
+				value, err := fn(i, target)
+				done <- clusterResult{target: target, value: value, err: err}
+			}()
+			select {
+			case result := <-done:
+				results[i] = result
+			case <-time.After(timeout):
+				results[i] = clusterResult{
+					target: target,
+					err:    fmt.Errorf("%s did not answer within %s", target, timeout),
+				}
+			}
+		}(i, target)
+	}
+	wg.Wait()
+
+	return results
+}
+
+// listClusterReleases lists the releases of all clusters, tagged by their
+// cluster.
+func listClusterReleases(c *gin.Context) {
+	targets, timeout, err := clusterTargetsFromRequest(c)
+	if err != nil {
+		respErr(c, err)
+		return
+	}
+
+	var options releaseListOptions
+	err = c.ShouldBindJSON(&options)
+	if err != nil && err != io.EOF {
+		respErr(c, err)
+		return
+	}
+	namespace := c.Query("namespace")
+	if namespace == "" {
+		options.AllNamespaces = true
+	}
+
+	results := fanOutClusters(targets, timeout, func(_ int, target clusterTarget) (interface{}, error) {
+		return runListReleases(fanOutKubeInformation(releaseTarget{clusterTarget: target, Namespace: namespace}, timeout), options)
+	})
+
+	list := &clusterReleaseList{
+		Releases:    []clusterReleaseElement{},
+		Unreachable: []clusterError{},
+	}
+	for _, result := range results {
+		if result.err != nil {
+			list.Unreachable = append(list.Unreachable, clusterError{
+				clusterTarget: result.target,
+				Error:         result.err.Error(),
+			})
+			continue
+		}
+		for _, element := range result.value.([]releaseElement) {
+			list.Releases = append(list.Releases, clusterReleaseElement{
+				clusterTarget:  result.target,
+				releaseElement: element,
+			})
+		}
+	}
+
+	respOK(c, list)
+}
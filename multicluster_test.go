@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newHungServer accepts connections and never answers them.
+func newHungServer(t *testing.T) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		lock  sync.Mutex
+		conns []net.Conn
+	)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			lock.Lock()
+			conns = append(conns, conn)
+			lock.Unlock()
+		}
+	}()
+	t.Cleanup(func() {
+		l.Close()
+		lock.Lock()
+		defer lock.Unlock()
+		for _, conn := range conns {
+			conn.Close()
+		}
+	})
+
+	return l.Addr().String()
+}
+
+func TestFanOutClustersCancelsHungCluster(t *testing.T) {
+	kubeConfig := filepath.Join(t.TempDir(), "config")
+	err := os.WriteFile(kubeConfig, []byte(fmt.Sprintf(`apiVersion: v1
+kind: Config
+clusters:
+- name: hung
+  cluster:
+    server: https://%s
+    insecure-skip-tls-verify: true
+contexts:
+- name: hung
+  context:
+    cluster: hung
+    user: hung
+current-context: hung
+users:
+- name: hung
+  user:
+    token: hung
+`, newHungServer(t))), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defaultKubeConfig := settings.KubeConfig
+	settings.KubeConfig = kubeConfig
+	t.Cleanup(func() { settings.KubeConfig = defaultKubeConfig })
+
+	timeout := 200 * time.Millisecond
+	var finished atomic.Bool
+	targets := []clusterTarget{{KubeContext: "hung"}}
+	results := fanOutClusters(targets, timeout, func(_ int, target clusterTarget) (interface{}, error) {
+		defer finished.Store(true)
+		kubeInfo := fanOutKubeInformation(releaseTarget{clusterTarget: target, Namespace: "default"}, timeout)
+		return runListReleases(kubeInfo, releaseListOptions{})
+	})
+	if results[0].err == nil || !strings.Contains(results[0].err.Error(), "did not answer") {
+		t.Fatalf("got error %v, want a timeout", results[0].err)
+	}
+
+	// the request of the worker is bounded by the timeout as well
+	deadline := time.Now().Add(10 * timeout)
+	for !finished.Load() {
+		if time.Now().After(deadline) {
+			t.Fatal("the worker still waits for the hung cluster")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
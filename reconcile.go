@@ -0,0 +1,519 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/release"
+	"helm.sh/helm/v3/pkg/storage/driver"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	planInstall   = "install"
+	planUpgrade   = "upgrade"
+	planUninstall = "uninstall"
+	planNoop      = "noop"
+	planSuspended = "suspended"
+)
+
+// desiredRelease is a release of a desired state document. Needs refers to
+// other releases as <name>, <namespace>/<name> or
+// <cluster or kube_context>/<namespace>/<name>.
+type desiredRelease struct {
+	Name      string   `json:"name"`
+	Namespace string   `json:"namespace"`
+	Chart     string   `json:"chart"`
+	Absent    bool     `json:"absent"`  // uninstall the release
+	Suspend   bool     `json:"suspend"` // leave the release as it is
+	Needs     []string `json:"needs"`
+	// Values are a map or, as the values of releases, a YAML document
+	Values interface{} `json:"values"`
+	clusterTarget
+	releaseOptions
+}
+
+type desiredState struct {
+	Releases []*desiredRelease `json:"releases"`
+}
+
+type planStep struct {
+	ID string `json:"id"`
+	releaseTarget
+	Name     string        `json:"name"`
+	Action   string        `json:"action"` // install, upgrade, uninstall, noop or suspended
+	Chart    string        `json:"chart,omitempty"`
+	Version  string        `json:"version,omitempty"`  // chart version to install or upgrade to
+	Revision int           `json:"revision,omitempty"` // deployed revision
+	Changes  []chartChange `json:"changes,omitempty"`  // reasons of an upgrade
+	Needs    []string      `json:"needs,omitempty"`    // ids of the needed releases
+	Status   string        `json:"status,omitempty"`   // succeeded, failed or skipped when applied
+	Error    string        `json:"error,omitempty"`
+
+	desired *desiredRelease
+}
+
+type reconcilePlan struct {
+	// Hash identifies the planned steps, apply refuses a plan with another
+	// hash
+	Hash string `json:"hash"`
+	// Steps are in apply order, uninstalls first in reverse order of their
+	// needs, then installs and upgrades in order of their needs
+	Steps []*planStep `json:"steps"`
+}
+
+func (r *desiredRelease) id() string {
+	id := r.Namespace + "/" + r.Name
+	if r.Cluster != "" {
+		return r.Cluster + "/" + id
+	}
+	if r.KubeContext != "" {
+		return r.KubeContext + "/" + id
+	}
+
+	return id
+}
+
+// resolveNeed returns the id of a release needed by r. <name> and
+// <namespace>/<name> are releases of the cluster of r, they take precedence
+// over a release of the default cluster with the same id.
+func (r *desiredRelease) resolveNeed(need string, ids map[string]bool) (string, error) {
+	prefix := strings.TrimSuffix(r.id(), r.Namespace+"/"+r.Name)
+	for _, id := range []string{prefix + r.Namespace + "/" + need, prefix + need, need} {
+		if ids[id] {
+			return id, nil
+		}
+	}
+
+	return "", fmt.Errorf("release %s needs unknown release %s", r.id(), need)
+}
+
+// bindValues sets the values of the release options from the values of the
+// document.
+func (r *desiredRelease) bindValues() error {
+	switch v := r.Values.(type) {
+	case nil:
+	case string:
+		r.releaseOptions.Values = v
+	case map[string]interface{}:
+		data, err := yaml.Marshal(v)
+		if err != nil {
+			return err
+		}
+		r.releaseOptions.Values = string(data)
+	default:
+		return fmt.Errorf("values of release %s must be a map or a YAML document", r.id())
+	}
+
+	return nil
+}
+
+// planHash returns the hash of the planned steps.
+func planHash(steps []*planStep) (string, error) {
+	data, err := json.Marshal(steps)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// desiredValues returns the values of a desired release as they are stored
+// in the release record.
+func desiredValues(options releaseOptions) (map[string]interface{}, error) {
+	vals, err := mergeValues(options)
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(vals)
+	if err != nil {
+		return nil, err
+	}
+	vals = map[string]interface{}{}
+	err = json.Unmarshal(data, &vals)
+
+	return vals, err
+}
+
+// planRelease compares a desired release with its deployed release.
+func planRelease(step *planStep) error {
+	r := step.desired
+	actionConfig, err := actionConfigInit(step.kubeInformation())
+	if err != nil {
+		return err
+	}
+	rls, err := action.NewGet(actionConfig).Run(r.Name)
+	if err != nil && !errors.Is(err, driver.ErrReleaseNotFound) {
+		return err
+	}
+	if rls != nil {
+		step.Revision = rls.Version
+	}
+
+	if r.Absent {
+		step.Action = planNoop
+		if rls != nil && rls.Info.Status != release.StatusUninstalled {
+			step.Action = planUninstall
+		}
+		return nil
+	}
+
+	chrt, err := loadChartWithOptions(r.Chart, r.ChartPathOptions)
+	if err != nil {
+		return err
+	}
+	step.Version = chrt.Metadata.Version
+	if rls == nil || rls.Info.Status == release.StatusUninstalled {
+		step.Action = planInstall
+		return nil
+	}
+
+	vals, err := desiredValues(r.releaseOptions)
+	if err != nil {
+		return err
+	}
+	step.Changes = diffMaps(map[string]interface{}{
+		"chart":         rls.Chart.Metadata.Name,
+		"chart_version": rls.Chart.Metadata.Version,
+		"status":        rls.Info.Status.String(),
+	}, map[string]interface{}{
+		"chart":         chrt.Metadata.Name,
+		"chart_version": chrt.Metadata.Version,
+		"status":        release.StatusDeployed.String(),
+	})
+	step.Changes = append(step.Changes, diffMaps(
+		flattenValues("values", rls.Config, map[string]interface{}{}),
+		flattenValues("values", vals, map[string]interface{}{}),
+	)...)
+	step.Action = planNoop
+	if len(step.Changes) > 0 {
+		step.Action = planUpgrade
+	}
+
+	return nil
+}
+
+// orderPlanSteps sorts the steps topologically by their needs, keeping the
+// order of the document otherwise. Steps with circular needs carry an error
+// and are put last.
+func orderPlanSteps(steps []*planStep) ([]*planStep, error) {
+	done := map[string]bool{}
+	var ordered []*planStep
+	var err error
+	for len(ordered) < len(steps) {
+		progress := false
+		for _, step := range steps {
+			if done[step.ID] {
+				continue
+			}
+			ready := true
+			for _, need := range step.Needs {
+				if !done[need] {
+					ready = false
+					break
+				}
+			}
+			if ready {
+				done[step.ID] = true
+				ordered = append(ordered, step)
+				progress = true
+			}
+		}
+		if !progress {
+			var cycle []*planStep
+			var ids []string
+			for _, step := range steps {
+				if !done[step.ID] {
+					cycle = append(cycle, step)
+					ids = append(ids, step.ID)
+				}
+			}
+			err = fmt.Errorf("circular needs between %s", strings.Join(ids, ", "))
+			for _, step := range cycle {
+				step.Error = err.Error()
+			}
+			ordered = append(ordered, cycle...)
+			break
+		}
+	}
+
+	var uninstalls, others []*planStep
+	for i := len(ordered) - 1; i >= 0; i-- {
+		if ordered[i].Action == planUninstall {
+			uninstalls = append(uninstalls, ordered[i])
+		}
+	}
+	for _, step := range ordered {
+		if step.Action != planUninstall {
+			others = append(others, step)
+		}
+	}
+
+	return append(uninstalls, others...), err
+}
+
+// validate checks a desired release before it is planned.
+func (r *desiredRelease) validate() error {
+	if r.Name == "" || r.Namespace == "" {
+		return fmt.Errorf("name and namespace of releases can not be empty")
+	}
+	if !r.Absent && r.Chart == "" {
+		return fmt.Errorf("chart of release %s can not be empty", r.id())
+	}
+	if err := r.bindValues(); err != nil {
+		return err
+	}
+	if r.Cluster != "" {
+		if _, err := managedClusters.registration(r.Cluster); err != nil {
+			return err
+		}
+	}
+	if !r.Absent {
+		// install with local uploaded charts, <name>@<version>
+		if err := checkChartPolicy(r.Chart, &r.ChartPathOptions); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// newPlanSteps returns a step of each release of a desired state. Releases
+// which are invalid, defined twice or need unknown releases carry their
+// error.
+func newPlanSteps(state *desiredState) []*planStep {
+	defined := map[string]int{}
+	ids := map[string]bool{}
+	for _, r := range state.Releases {
+		defined[r.id()]++
+		ids[r.id()] = true
+	}
+
+	steps := make([]*planStep, 0, len(state.Releases))
+	for _, r := range state.Releases {
+		step := &planStep{
+			ID:            r.id(),
+			releaseTarget: releaseTarget{clusterTarget: r.clusterTarget, Namespace: r.Namespace},
+			Name:          r.Name,
+			Chart:         r.Chart,
+			desired:       r,
+		}
+		steps = append(steps, step)
+		if err := r.validate(); err != nil {
+			step.Error = err.Error()
+			continue
+		}
+		if defined[r.id()] > 1 {
+			step.Error = fmt.Sprintf("release %s is defined twice", r.id())
+			continue
+		}
+		for _, need := range r.Needs {
+			id, err := r.resolveNeed(need, ids)
+			if err != nil {
+				step.Error = err.Error()
+				break
+			}
+			step.Needs = append(step.Needs, id)
+		}
+	}
+
+	return steps
+}
+
+// planReleases plans the steps without an error concurrently. Steps which
+// could not be planned carry their error.
+func planReleases(steps []*planStep) {
+	var wg sync.WaitGroup
+	for _, step := range steps {
+		if step.desired.Suspend {
+			step.Action = planSuspended
+			continue
+		}
+		if step.Error != "" {
+			continue
+		}
+		wg.Add(1)
+		go func(step *planStep) {
+			defer wg.Done()
+			if err := planRelease(step); err != nil {
+				step.Error = err.Error()
+			}
+		}(step)
+	}
+	wg.Wait()
+}
+
+// planDesiredState computes the steps reconciling the deployed releases with
+// a desired state. An invalid release fails the plan, steps which could not
+// be planned carry their error.
+func planDesiredState(state *desiredState) (*reconcilePlan, error) {
+	steps := newPlanSteps(state)
+	for _, step := range steps {
+		if step.Error != "" {
+			return nil, errors.New(step.Error)
+		}
+	}
+	planReleases(steps)
+
+	steps, err := orderPlanSteps(steps)
+	if err != nil {
+		return nil, err
+	}
+	hash, err := planHash(steps)
+	if err != nil {
+		return nil, err
+	}
+
+	return &reconcilePlan{Hash: hash, Steps: steps}, nil
+}
+
+func applyPlanStep(step *planStep) error {
+	r := step.desired
+	kubeInfo := step.kubeInformation()
+	switch step.Action {
+	case planUninstall:
+		actionConfig, err := actionConfigInit(kubeInfo)
+		if err != nil {
+			return err
+		}
+		if r.Timeout == "" {
+			r.Timeout = defaultTimeout
+		}
+		client := action.NewUninstall(actionConfig)
+		client.DryRun = r.DryRun
+		client.DisableHooks = r.DisableHooks
+		client.Wait = r.Wait
+		client.Description = r.Description
+		client.Timeout, err = time.ParseDuration(r.Timeout)
+		if err != nil {
+			return err
+		}
+		_, err = client.Run(r.Name)
+		return err
+	case planInstall, planUpgrade:
+		aimChart, err := resolveUploadedChart(r.Chart)
+		if err != nil {
+			return err
+		}
+		options := r.releaseOptions
+		options.Version = step.Version
+		if step.Action == planInstall {
+			return runInstall(r.Name, aimChart, kubeInfo, options)
+		}
+		options.Install = false
+		return runUpgrade(r.Name, aimChart, kubeInfo, options)
+	}
+
+	return nil
+}
+
+// applyPlan runs the steps in order and halts on the first failure, the
+// remaining steps are skipped.
+func applyPlan(plan *reconcilePlan) error {
+	var failed error
+	for _, step := range plan.Steps {
+		if step.Action == planNoop || step.Action == planSuspended {
+			continue
+		}
+		if failed != nil {
+			step.Status = rolloutSkipped
+			continue
+		}
+		if err := applyPlanStep(step); err != nil {
+			step.Status = rolloutFailed
+			step.Error = err.Error()
+			failed = fmt.Errorf("%s of %s failed: %s", step.Action, step.ID, err)
+			continue
+		}
+		step.Status = rolloutSucceeded
+	}
+
+	return failed
+}
+
+func bindDesiredState(c *gin.Context) (*desiredState, error) {
+	body, err := c.GetRawData()
+	if err != nil {
+		return nil, err
+	}
+	state := &desiredState{}
+	if c.Query("format") == "helmfile" {
+		state, err = importHelmfile(body)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		// json is a subset of yaml, the document may be either
+		err = yaml.Unmarshal(body, state)
+		if err != nil {
+			return nil, fmt.Errorf("failed parsing desired state: %s", err)
+		}
+	}
+	if len(state.Releases) == 0 {
+		return nil, fmt.Errorf("releases can not be empty")
+	}
+
+	return state, nil
+}
+
+// planReconcile returns the plan of a desired state for review.
+func planReconcile(c *gin.Context) {
+	state, err := bindDesiredState(c)
+	if err != nil {
+		respErr(c, err)
+		return
+	}
+	plan, err := planDesiredState(state)
+	if err != nil {
+		respErr(c, err)
+		return
+	}
+
+	respOK(c, plan)
+}
+
+// applyReconcile plans a desired state again and applies the plan if it is
+// the reviewed plan.
+func applyReconcile(c *gin.Context) {
+	reviewed := c.Query("plan")
+	if reviewed == "" {
+		respErr(c, fmt.Errorf("plan can not be empty, plan the desired state and apply it with the hash of the plan"))
+		return
+	}
+	state, err := bindDesiredState(c)
+	if err != nil {
+		respErr(c, err)
+		return
+	}
+	plan, err := planDesiredState(state)
+	if err != nil {
+		respErr(c, err)
+		return
+	}
+	if plan.Hash != reviewed {
+		respErrWithData(c, fmt.Errorf("plan %s changed since the review, the plan is now %s", reviewed, plan.Hash), plan)
+		return
+	}
+	for _, step := range plan.Steps {
+		if step.Error != "" {
+			respErrWithData(c, fmt.Errorf("failed to plan %s: %s", step.ID, step.Error), plan)
+			return
+		}
+	}
+
+	if err := applyPlan(plan); err != nil {
+		respErrWithData(c, err, plan)
+		return
+	}
+
+	respOK(c, plan)
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"sigs.k8s.io/yaml"
+)
+
+func TestResolveNeed(t *testing.T) {
+	ids := map[string]bool{
+		"shop/db":       true,
+		"shop/cache":    true,
+		"prod/shop/db":  true,
+		"prod/infra/mq": true,
+	}
+
+	tests := []struct {
+		name    string
+		release desiredRelease
+		need    string
+		want    string
+		wantErr bool
+	}{
+		{
+			name:    "name in the namespace",
+			release: desiredRelease{Name: "web", Namespace: "shop"},
+			need:    "db",
+			want:    "shop/db",
+		},
+		{
+			name:    "name in the namespace of a cluster",
+			release: desiredRelease{Name: "web", Namespace: "shop", clusterTarget: clusterTarget{Cluster: "prod"}},
+			need:    "db",
+			want:    "prod/shop/db",
+		},
+		{
+			name:    "namespace and name in the cluster of the release",
+			release: desiredRelease{Name: "web", Namespace: "shop", clusterTarget: clusterTarget{Cluster: "prod"}},
+			need:    "shop/db",
+			want:    "prod/shop/db",
+		},
+		{
+			name:    "namespace and name in another namespace",
+			release: desiredRelease{Name: "web", Namespace: "shop", clusterTarget: clusterTarget{KubeContext: "prod"}},
+			need:    "infra/mq",
+			want:    "prod/infra/mq",
+		},
+		{
+			name:    "release of another cluster",
+			release: desiredRelease{Name: "web", Namespace: "shop", clusterTarget: clusterTarget{Cluster: "prod"}},
+			need:    "shop/cache",
+			want:    "shop/cache",
+		},
+		{
+			name:    "full id",
+			release: desiredRelease{Name: "web", Namespace: "shop"},
+			need:    "prod/shop/db",
+			want:    "prod/shop/db",
+		},
+		{
+			name:    "unknown release",
+			release: desiredRelease{Name: "web", Namespace: "shop"},
+			need:    "mq",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.release.resolveNeed(tt.need, ids)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("got %s, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDesiredReleaseValues(t *testing.T) {
+	tests := []struct {
+		name     string
+		document string
+		want     map[string]interface{}
+		wantErr  bool
+	}{
+		{
+			name:     "map",
+			document: "releases: [{name: web, namespace: shop, chart: nginx, values: {replicaCount: 2, service: {type: NodePort}}}]",
+			want:     map[string]interface{}{"replicaCount": float64(2), "service": map[string]interface{}{"type": "NodePort"}},
+		},
+		{
+			name:     "yaml document",
+			document: "releases: [{name: web, namespace: shop, chart: nginx, values: 'replicaCount: 2'}]",
+			want:     map[string]interface{}{"replicaCount": float64(2)},
+		},
+		{
+			name:     "map with set",
+			document: "releases: [{name: web, namespace: shop, chart: nginx, values: {replicaCount: 2}, set: [replicaCount=3]}]",
+			want:     map[string]interface{}{"replicaCount": float64(3)},
+		},
+		{
+			name:     "no values",
+			document: "releases: [{name: web, namespace: shop, chart: nginx}]",
+			want:     map[string]interface{}{},
+		},
+		{
+			name:     "list",
+			document: "releases: [{name: web, namespace: shop, chart: nginx, values: [replicaCount]}]",
+			wantErr:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state := &desiredState{}
+			if err := yaml.Unmarshal([]byte(tt.document), state); err != nil {
+				t.Fatal(err)
+			}
+			r := state.Releases[0]
+			err := r.bindValues()
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := desiredValues(r.releaseOptions)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got values %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPlanHash(t *testing.T) {
+	plan := func(revision int, replicas interface{}) []*planStep {
+		return []*planStep{
+			{ID: "shop/db", Name: "db", Action: planNoop, Chart: "postgresql", Version: "12.1.0", Revision: 2},
+			{
+				ID:       "shop/web",
+				Name:     "web",
+				Action:   planUpgrade,
+				Chart:    "nginx",
+				Version:  "15.0.0",
+				Revision: revision,
+				Changes:  []chartChange{{Path: "values.replicaCount", Type: changeChanged, From: 1, To: replicas}},
+				Needs:    []string{"shop/db"},
+			},
+		}
+	}
+
+	reviewed, err := planHash(plan(6, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name  string
+		steps []*planStep
+		same  bool
+	}{
+		{name: "same plan", steps: plan(6, 2), same: true},
+		{name: "release upgraded since", steps: plan(7, 2)},
+		{name: "other values", steps: plan(6, 3)},
+		{name: "other order", steps: []*planStep{plan(6, 2)[1], plan(6, 2)[0]}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := planHash(tt.steps)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (got == reviewed) != tt.same {
+				t.Errorf("got hash %s, reviewed %s, want same %v", got, reviewed, tt.same)
+			}
+		})
+	}
+}
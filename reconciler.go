@@ -0,0 +1,342 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang/glog"
+	"sigs.k8s.io/yaml"
+)
+
+const defaultReconcileInterval = 5 * time.Minute
+
+type ReconcileConfig struct {
+	// Path is the directory of the desired state documents and helmfiles,
+	// e.g. a mounted ConfigMap or the checkout of a git-sync sidecar
+	Path string `yaml:"path"`
+	// Interval of the reconciliation, default 5m
+	Interval string `yaml:"interval"`
+}
+
+type reconciledRelease struct {
+	*planStep
+	File       string    `json:"file"`
+	Reconciled time.Time `json:"reconciled"`
+}
+
+type reconcilerStatus struct {
+	Path     string               `json:"path"`
+	Interval string               `json:"interval"`
+	LastRun  *time.Time           `json:"last_run,omitempty"`
+	Error    string               `json:"error,omitempty"` // of the last run
+	Releases []*reconciledRelease `json:"releases"`
+}
+
+// specReconciler reconciles the clusters with the release specs of a
+// directory periodically.
+type specReconciler struct {
+	sync.Mutex
+	path     string
+	interval time.Duration
+	lastRun  *time.Time
+	err      error
+	releases map[string]*reconciledRelease // by release id
+}
+
+var reconciler = &specReconciler{
+	releases: map[string]*reconciledRelease{},
+}
+
+// initReconciler starts the periodic reconciliation if a spec directory is
+// configured.
+func initReconciler() error {
+	config := helmConfig.Reconcile
+	if config == nil || config.Path == "" {
+		return nil
+	}
+	reconciler.path = config.Path
+	reconciler.interval = defaultReconcileInterval
+	if config.Interval != "" {
+		d, err := time.ParseDuration(config.Interval)
+		if err != nil {
+			return fmt.Errorf("invalid reconcile interval %s: %s", config.Interval, err)
+		}
+		if d <= 0 {
+			return fmt.Errorf("invalid reconcile interval %s", config.Interval)
+		}
+		reconciler.interval = d
+	}
+
+	go func() {
+		for {
+			reconciler.run()
+			time.Sleep(reconciler.interval)
+		}
+	}()
+
+	return nil
+}
+
+// isHelmfile reports whether a spec file is a helmfile, helmfile.yaml or
+// <name>.helmfile.yaml, other files are desired state documents.
+func isHelmfile(name string) bool {
+	base := strings.TrimSuffix(strings.TrimSuffix(name, ".yaml"), ".yml")
+	return base == "helmfile" || strings.HasSuffix(base, ".helmfile")
+}
+
+// specFiles returns the resolved directory and the yaml and json files
+// below it. Symlinks are followed, as ConfigMap volumes and git-sync link
+// their content, and hidden entries like .git or ..data are skipped.
+func specFiles(dir string) (string, []string, error) {
+	root, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return "", nil, err
+	}
+
+	var files []string
+	err = filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if p != root && strings.HasPrefix(d.Name(), ".") {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			return nil
+		}
+		switch filepath.Ext(p) {
+		case ".yaml", ".yml", ".json":
+		default:
+			return nil
+		}
+		info, err := os.Stat(p)
+		if err != nil || !info.Mode().IsRegular() {
+			return nil
+		}
+		files = append(files, p)
+		return nil
+	})
+	sort.Strings(files)
+
+	return root, files, err
+}
+
+// loadSpecs merges the release specs of all files into one desired state,
+// releases may need releases of other files. Files which could not be read
+// or parsed are returned with their error, the other files are loaded.
+func loadSpecs(dir string) (*desiredState, map[string]string, map[string]error, error) {
+	root, files, err := specFiles(dir)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	state := &desiredState{}
+	sources := map[string]string{}
+	failed := map[string]error{}
+	for _, f := range files {
+		rel, err := filepath.Rel(root, f)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		data, err := os.ReadFile(f)
+		if err != nil {
+			failed[rel] = err
+			continue
+		}
+		s := &desiredState{}
+		if isHelmfile(filepath.Base(f)) {
+			s, err = importHelmfile(data)
+		} else {
+			err = yaml.Unmarshal(data, s)
+		}
+		if err != nil {
+			failed[rel] = err
+			continue
+		}
+		for _, r := range s.Releases {
+			sources[r.id()] = rel
+		}
+		state.Releases = append(state.Releases, s.Releases...)
+	}
+
+	return state, sources, failed, nil
+}
+
+// applyReleases runs the steps in order. A failed release holds back the
+// releases which need it, and uninstalls of the releases it needs, the
+// other releases are applied.
+func applyReleases(steps []*planStep) int {
+	held := map[string]bool{}
+	for _, step := range steps {
+		if step.Error != "" {
+			step.Status = rolloutFailed
+			held[step.ID] = true
+		}
+	}
+
+	failed := 0
+	for _, step := range steps {
+		if step.Status == rolloutFailed {
+			failed++
+			continue
+		}
+		if step.Action == planNoop || step.Action == planSuspended {
+			continue
+		}
+		var blocking []string
+		if step.Action == planUninstall {
+			// needed releases are uninstalled after the releases needing them
+			for _, other := range steps {
+				for _, need := range other.Needs {
+					if need == step.ID && other.Action == planUninstall && held[other.ID] {
+						blocking = append(blocking, other.ID)
+					}
+				}
+			}
+		} else {
+			for _, need := range step.Needs {
+				if held[need] {
+					blocking = append(blocking, need)
+				}
+			}
+		}
+		if len(blocking) > 0 {
+			step.Status = rolloutSkipped
+			step.Error = fmt.Sprintf("held back by %s", strings.Join(blocking, ", "))
+			held[step.ID] = true
+			continue
+		}
+		if err := applyPlanStep(step); err != nil {
+			step.Status = rolloutFailed
+			step.Error = err.Error()
+			held[step.ID] = true
+			failed++
+			continue
+		}
+		step.Status = rolloutSucceeded
+	}
+
+	return failed
+}
+
+func (r *specReconciler) run() {
+	now := time.Now()
+	err := r.reconcile(now)
+	if err != nil {
+		glog.Warningf("reconcile %s: %s", r.path, err)
+	}
+
+	r.Lock()
+	defer r.Unlock()
+	r.lastRun = &now
+	r.err = err
+}
+
+// reconcile plans and applies each release on its own, a release which
+// could not be planned or applied does not stop the others.
+func (r *specReconciler) reconcile(now time.Time) error {
+	state, sources, failedFiles, err := loadSpecs(r.path)
+	if err != nil {
+		return err
+	}
+
+	steps := newPlanSteps(state)
+	planReleases(steps)
+	steps, _ = orderPlanSteps(steps)
+	failed := applyReleases(steps)
+	r.record(steps, sources, failedFiles, now)
+
+	var errs []string
+	files := make([]string, 0, len(failedFiles))
+	for f := range failedFiles {
+		files = append(files, f)
+	}
+	sort.Strings(files)
+	for _, f := range files {
+		errs = append(errs, fmt.Sprintf("%s: %s", f, failedFiles[f]))
+	}
+	if failed > 0 {
+		errs = append(errs, fmt.Sprintf("%d of %d releases failed", failed, len(steps)))
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+
+	return nil
+}
+
+// record keeps the result of the steps of a run, releases removed from the
+// specs are dropped. The releases of files which could not be loaded keep
+// their last result and fail with the error of the file.
+func (r *specReconciler) record(steps []*planStep, sources map[string]string, failedFiles map[string]error, now time.Time) {
+	r.Lock()
+	defer r.Unlock()
+
+	releases := map[string]*reconciledRelease{}
+	for _, step := range steps {
+		releases[step.ID] = &reconciledRelease{
+			planStep:   step,
+			File:       sources[step.ID],
+			Reconciled: now,
+		}
+	}
+	for id, last := range r.releases {
+		err, ok := failedFiles[last.File]
+		if !ok || releases[id] != nil {
+			continue
+		}
+		step := *last.planStep
+		step.Status = rolloutFailed
+		step.Error = fmt.Sprintf("failed loading %s: %s", last.File, err)
+		releases[id] = &reconciledRelease{
+			planStep:   &step,
+			File:       last.File,
+			Reconciled: now,
+		}
+	}
+	r.releases = releases
+}
+
+func (r *specReconciler) status() *reconcilerStatus {
+	r.Lock()
+	defer r.Unlock()
+
+	status := &reconcilerStatus{
+		Path:     r.path,
+		Interval: r.interval.String(),
+		LastRun:  r.lastRun,
+		Releases: []*reconciledRelease{},
+	}
+	if r.err != nil {
+		status.Error = r.err.Error()
+	}
+	for _, release := range r.releases {
+		status.Releases = append(status.Releases, release)
+	}
+	sort.Slice(status.Releases, func(i, j int) bool {
+		return status.Releases[i].ID < status.Releases[j].ID
+	})
+
+	return status
+}
+
+// getReconcileStatus returns the last reconcile result of each release of
+// the spec directory.
+func getReconcileStatus(c *gin.Context) {
+	if reconciler.path == "" {
+		respErr(c, fmt.Errorf("reconciliation of a spec directory is not configured"))
+		return
+	}
+
+	respOK(c, reconciler.status())
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReconcileReleasesIndependently(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"broken.yaml": "releases: [{name: mq",
+		"shop.yaml": `
+releases:
+- name: web
+  namespace: shop
+- name: api
+  namespace: shop
+  chart: nginx
+  needs: [db]
+- name: cache
+  namespace: shop
+  chart: redis
+  suspend: true
+`,
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r := &specReconciler{
+		path: dir,
+		releases: map[string]*reconciledRelease{
+			"infra/mq": {
+				planStep: &planStep{ID: "infra/mq", Name: "mq", Action: planNoop},
+				File:     "broken.yaml",
+			},
+		},
+	}
+	err := r.reconcile(time.Now())
+	if err == nil || !strings.Contains(err.Error(), "broken.yaml") || !strings.Contains(err.Error(), "2 of 3 releases failed") {
+		t.Errorf("got error %v, want the broken file and 2 of 3 releases failed", err)
+	}
+
+	want := map[string]struct {
+		status string
+		err    string
+	}{
+		"infra/mq":   {status: rolloutFailed, err: "failed loading broken.yaml"},
+		"shop/web":   {status: rolloutFailed, err: "chart of release shop/web can not be empty"},
+		"shop/api":   {status: rolloutFailed, err: "needs unknown release db"},
+		"shop/cache": {},
+	}
+	status := r.status()
+	if len(status.Releases) != len(want) {
+		t.Fatalf("got %d releases, want %d", len(status.Releases), len(want))
+	}
+	for _, release := range status.Releases {
+		w, ok := want[release.ID]
+		if !ok {
+			t.Errorf("unexpected release %s", release.ID)
+			continue
+		}
+		if release.Status != w.status || !strings.Contains(release.Error, w.err) {
+			t.Errorf("%s: got status %q error %q, want %q %q", release.ID, release.Status, release.Error, w.status, w.err)
+		}
+	}
+	if cache := r.releases["shop/cache"]; cache.Action != planSuspended {
+		t.Errorf("shop/cache: got action %s, want %s", cache.Action, planSuspended)
+	}
+}
+
+func TestLoadSpecsOfALinkedDirectory(t *testing.T) {
+	// a ConfigMap volume links its files through ..data
+	dir := t.TempDir()
+	data := filepath.Join(dir, "..2024_01_01")
+	if err := os.MkdirAll(filepath.Join(data, "apps"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	spec := "releases:\n- name: web\n  namespace: shop\n  chart: nginx\n"
+	if err := os.WriteFile(filepath.Join(data, "apps", "shop.yaml"), []byte(spec), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(data, filepath.Join(dir, "..data")); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(t.TempDir(), "specs")
+	if err := os.Symlink(filepath.Join(dir, "..data"), link); err != nil {
+		t.Fatal(err)
+	}
+
+	state, sources, failed, err := loadSpecs(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(failed) != 0 {
+		t.Errorf("failed files: %v", failed)
+	}
+	if len(state.Releases) != 1 {
+		t.Fatalf("got %d releases, want 1", len(state.Releases))
+	}
+	if got := sources[state.Releases[0].id()]; got != filepath.Join("apps", "shop.yaml") {
+		t.Errorf("got source %q, want apps/shop.yaml", got)
+	}
+}
+
+func TestApplyReleasesHoldsBackNeeds(t *testing.T) {
+	steps := []*planStep{
+		{ID: "shop/old", Action: planUninstall, Needs: []string{"shop/legacy"}, Error: "connection refused"},
+		{ID: "shop/legacy", Action: planUninstall},
+		{ID: "shop/db", Action: planUpgrade, Error: "chart not found"},
+		{ID: "shop/web", Action: planInstall, Needs: []string{"shop/db"}},
+		{ID: "shop/api", Action: planInstall, Needs: []string{"shop/web"}},
+		{ID: "shop/cache", Action: planNoop},
+	}
+	if failed := applyReleases(steps); failed != 2 {
+		t.Errorf("got %d failed releases, want 2", failed)
+	}
+
+	want := map[string]string{
+		"shop/old":    rolloutFailed,
+		"shop/legacy": rolloutSkipped,
+		"shop/db":     rolloutFailed,
+		"shop/web":    rolloutSkipped,
+		"shop/api":    rolloutSkipped,
+		"shop/cache":  "",
+	}
+	for _, step := range steps {
+		if step.Status != want[step.ID] {
+			t.Errorf("%s: got status %q, want %q", step.ID, step.Status, want[step.ID])
+		}
+	}
+}
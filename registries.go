@@ -1,22 +1,58 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"io"
+	"net/http"
 	"os"
+	"sort"
 	"strings"
+	"sync"
 
+	"github.com/gin-gonic/gin"
 	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chart/loader"
 	"helm.sh/helm/v3/pkg/registry"
 	"helm.sh/helm/v3/pkg/repo"
 )
 
 type RegistryConfig struct {
-	Host	 string
-	Username string
-	Password string
-	CertFile string
-	KeyFile  string
-	CAFile   string
+	Host                  string `json:"host"`
+	Username              string `json:"username"`
+	Password              string `json:"password"`
+	CertFile              string `json:"cert_file"`
+	KeyFile               string `json:"key_file"`
+	CAFile                string `json:"ca_file"`
+	InsecureSkipTLSverify bool   `json:"insecure_skip_verify"`
+	PlainHTTP             bool   `json:"plain_http"`
+}
+
+type registryElement struct {
+	Host     string `json:"host"`
+	Username string `json:"username"`
+	LoggedIn bool   `json:"logged_in"`
+}
+
+// registryStore keeps the configured OCI registries and one long-lived
+// registry client per host, so credentials and auth caches are reused
+// across requests.
+type registryStore struct {
+	sync.RWMutex
+	configs map[string]*RegistryConfig
+	clients map[string]*registry.Client
+	logins  map[string]bool
+	// static are the hosts of helmRegistries, their config outlives a logout
+	static map[string]bool
+}
+
+var ociRegistries = &registryStore{
+	configs: map[string]*RegistryConfig{},
+	clients: map[string]*registry.Client{},
+	logins:  map[string]bool{},
+	static:  map[string]bool{},
 }
 
 func repoEntryToRegistryConfig(repoEntry *repo.Entry) (*RegistryConfig, error) {
@@ -25,17 +61,18 @@ func repoEntryToRegistryConfig(repoEntry *repo.Entry) (*RegistryConfig, error) {
 	}
 
 	hostParts := strings.Split(repoEntry.URL, "oci://")
-	if len(hostParts) != 2 {
+	if len(hostParts) != 2 || hostParts[1] == "" {
 		return nil, fmt.Errorf("Invalid OCI registry URL: %s", repoEntry.URL)
 	}
 
 	registryConfig := RegistryConfig{
-		Host: hostParts[1],
-		Username: repoEntry.Username,
-		Password: repoEntry.Password,
-		CertFile: repoEntry.CertFile,
-		KeyFile: repoEntry.KeyFile,
-		CAFile: repoEntry.CAFile,
+		Host:                  strings.TrimSuffix(hostParts[1], "/"),
+		Username:              repoEntry.Username,
+		Password:              repoEntry.Password,
+		CertFile:              repoEntry.CertFile,
+		KeyFile:               repoEntry.KeyFile,
+		CAFile:                repoEntry.CAFile,
+		InsecureSkipTLSverify: repoEntry.InsecureSkipTLSverify,
 	}
 
 	return &registryConfig, nil
@@ -43,71 +80,290 @@ func repoEntryToRegistryConfig(repoEntry *repo.Entry) (*RegistryConfig, error) {
 
 func chartPathOptionsToRegistryConfig(aimChart *string, chartPathOptions *action.ChartPathOptions) (*RegistryConfig, error) {
 	if !strings.HasPrefix(*aimChart, "oci://") {
-		return nil, fmt.Errorf("Invalid OCI chart url: %s", aimChart)
+		return nil, fmt.Errorf("Invalid OCI chart url: %s", *aimChart)
 	}
 
 	chartUrlParts := strings.Split(*aimChart, "oci://")
 	if len(chartUrlParts) != 2 {
-		return nil, fmt.Errorf("Invalid OCI chart url: %s", aimChart)
+		return nil, fmt.Errorf("Invalid OCI chart url: %s", *aimChart)
 	}
 
 	hostParts := strings.Split(chartUrlParts[1], "/")
 	if len(hostParts) < 2 {
-		return nil, fmt.Errorf("Invalid OCI chart url: %s", aimChart)
+		return nil, fmt.Errorf("Invalid OCI chart url: %s", *aimChart)
 	}
 
 	registryConfig := RegistryConfig{
-		Host: hostParts[0],
-		Username: chartPathOptions.Username,
-		Password: chartPathOptions.Password,
-		CertFile: chartPathOptions.CertFile,
-		KeyFile: chartPathOptions.KeyFile,
-		CAFile: chartPathOptions.CaFile,
+		Host:                  hostParts[0],
+		Username:              chartPathOptions.Username,
+		Password:              chartPathOptions.Password,
+		CertFile:              chartPathOptions.CertFile,
+		KeyFile:               chartPathOptions.KeyFile,
+		CAFile:                chartPathOptions.CaFile,
+		InsecureSkipTLSverify: chartPathOptions.InsecureSkipTLSverify,
+		PlainHTTP:             chartPathOptions.PlainHTTP,
 	}
 
 	return &registryConfig, nil
 }
 
-func createOCIRegistryClient(registryConfig *RegistryConfig) (*registry.Client, error) {
+// registryTLSConfig builds the client TLS configuration of a registry, as
+// registry.NewRegistryClientWithTLS does.
+func registryTLSConfig(registryConfig *RegistryConfig) (*tls.Config, error) {
+	tlsConf := &tls.Config{
+		InsecureSkipVerify: registryConfig.InsecureSkipTLSverify,
+	}
+	if registryConfig.CertFile != "" && registryConfig.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(registryConfig.CertFile, registryConfig.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("can't load client certificate: %s", err)
+		}
+		tlsConf.Certificates = []tls.Certificate{cert}
+	}
+	if registryConfig.CAFile != "" {
+		ca, err := os.ReadFile(registryConfig.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("can't read CA file: %s", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("failed to append certificates from file: %s", registryConfig.CAFile)
+		}
+		tlsConf.RootCAs = pool
+	}
+
+	return tlsConf, nil
+}
+
+func newOCIRegistryClient(registryConfig *RegistryConfig) (*registry.Client, error) {
+	var out io.Writer = io.Discard
+	if settings.Debug {
+		out = os.Stdout
+	}
+
 	opts := []registry.ClientOption{
-		registry.ClientOptDebug(true),
+		registry.ClientOptDebug(settings.Debug),
 		registry.ClientOptEnableCache(true),
-		registry.ClientOptWriter(os.Stdout),
+		registry.ClientOptWriter(out),
 		registry.ClientOptCredentialsFile(settings.RegistryConfig),
 	}
+	if registryConfig.CertFile != "" || registryConfig.KeyFile != "" || registryConfig.CAFile != "" ||
+		registryConfig.InsecureSkipTLSverify {
+		tlsConf, err := registryTLSConfig(registryConfig)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to create registry client: %s", err)
+		}
+		opts = append(opts, registry.ClientOptHTTPClient(&http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: tlsConf,
+				Proxy:           http.ProxyFromEnvironment,
+			},
+		}))
+	}
+	if registryConfig.PlainHTTP {
+		opts = append(opts, registry.ClientOptPlainHTTP())
+	}
+	if registryConfig.Username != "" && registryConfig.Password != "" {
+		opts = append(opts, registry.ClientOptBasicAuth(registryConfig.Username, registryConfig.Password))
+	}
 
 	registryClient, err := registry.NewClient(opts...)
 	if err != nil {
 		return nil, fmt.Errorf("Failed to create registry client: %s", err)
 	}
 
-	if registryConfig.Username != "" && registryConfig.Password != "" {
-		registryClient.Login(
-			registryConfig.Host,
-			registry.LoginOptBasicAuth(
-				registryConfig.Username,
-				registryConfig.Password,
-			),
-			registry.LoginOptInsecure(false),
-			registry.LoginOptTLSClientConfig(
-				registryConfig.CertFile,
-				registryConfig.KeyFile,
-				registryConfig.CAFile,
-			),
-		)
+	return registryClient, nil
+}
+
+// client returns the cached registry client for the host, creating it on
+// first use. Configured registries take precedence over the per-request
+// TLS options, which only apply when the host is not configured.
+func (s *registryStore) client(registryConfig *RegistryConfig) (*registry.Client, error) {
+	s.RLock()
+	registryClient, ok := s.clients[registryConfig.Host]
+	s.RUnlock()
+	if ok {
+		return registryClient, nil
 	}
 
+	s.Lock()
+	defer s.Unlock()
+	if registryClient, ok := s.clients[registryConfig.Host]; ok {
+		return registryClient, nil
+	}
+	if c, ok := s.configs[registryConfig.Host]; ok {
+		registryConfig = c
+	}
+	registryClient, err := newOCIRegistryClient(registryConfig)
+	if err != nil {
+		return nil, err
+	}
+	s.clients[registryConfig.Host] = registryClient
+
 	return registryClient, nil
 }
 
-func initRegistry(c *repo.Entry) (error) {
+// login logs into the registry and persists the credentials to
+// settings.RegistryConfig. A changed TLS configuration replaces the cached
+// client of the host.
+func (s *registryStore) login(registryConfig *RegistryConfig) error {
+	registryClient, err := newOCIRegistryClient(registryConfig)
+	if err != nil {
+		return err
+	}
+
+	err = registryClient.Login(
+		registryConfig.Host,
+		registry.LoginOptBasicAuth(
+			registryConfig.Username,
+			registryConfig.Password,
+		),
+		registry.LoginOptInsecure(registryConfig.InsecureSkipTLSverify || registryConfig.PlainHTTP),
+		registry.LoginOptTLSClientConfig(
+			registryConfig.CertFile,
+			registryConfig.KeyFile,
+			registryConfig.CAFile,
+		),
+	)
+	if err != nil {
+		return fmt.Errorf("Failed to login to registry %s: %s", registryConfig.Host, err)
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	s.configs[registryConfig.Host] = registryConfig
+	s.clients[registryConfig.Host] = registryClient
+	s.logins[registryConfig.Host] = true
+
+	return nil
+}
+
+func (s *registryStore) logout(host string) error {
+	s.RLock()
+	registryConfig, ok := s.configs[host]
+	s.RUnlock()
+	if !ok {
+		registryConfig = &RegistryConfig{Host: host}
+	}
+
+	registryClient, err := s.client(registryConfig)
+	if err != nil {
+		return err
+	}
+	if err := registryClient.Logout(host); err != nil {
+		return fmt.Errorf("Failed to logout from registry %s: %s", host, err)
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	delete(s.clients, host)
+	delete(s.logins, host)
+	if !s.static[host] {
+		delete(s.configs, host)
+		return nil
+	}
+	// keep the TLS and plain HTTP settings of a configured host
+	if c, ok := s.configs[host]; ok {
+		kept := *c
+		kept.Username, kept.Password = "", ""
+		s.configs[host] = &kept
+	}
+
+	return nil
+}
+
+// dependencyClient returns the registry client of the OCI dependencies of a
+// chart. The dependency downloader takes a single client, so dependencies
+// may come from several hosts only if at most one of them is configured.
+func (s *registryStore) dependencyClient(deps []*chart.Dependency) (*registry.Client, error) {
+	var hosts, configured []string
+	seen := map[string]bool{}
+	s.RLock()
+	for _, dep := range deps {
+		if !strings.HasPrefix(dep.Repository, "oci://") {
+			continue
+		}
+		host := strings.SplitN(strings.TrimPrefix(dep.Repository, "oci://"), "/", 2)[0]
+		if seen[host] {
+			continue
+		}
+		seen[host] = true
+		hosts = append(hosts, host)
+		if _, ok := s.configs[host]; ok {
+			configured = append(configured, host)
+		}
+	}
+	s.RUnlock()
+
+	switch {
+	case len(configured) > 1:
+		return nil, fmt.Errorf("dependencies from several configured OCI registries are not supported: %s",
+			strings.Join(configured, ", "))
+	case len(configured) == 1:
+		return s.client(&RegistryConfig{Host: configured[0]})
+	case len(hosts) > 0:
+		return s.client(&RegistryConfig{Host: hosts[0]})
+	}
+
+	return newOCIRegistryClient(&RegistryConfig{})
+}
+
+func (s *registryStore) list() []registryElement {
+	s.RLock()
+	defer s.RUnlock()
+
+	elements := make([]registryElement, 0, len(s.configs))
+	for host, c := range s.configs {
+		elements = append(elements, registryElement{
+			Host:     host,
+			Username: c.Username,
+			LoggedIn: s.logins[host],
+		})
+	}
+	sort.Slice(elements, func(i, j int) bool {
+		return elements[i].Host < elements[j].Host
+	})
+
+	return elements
+}
+
+func initRegistry(c *repo.Entry) error {
 	registryConfig, err := repoEntryToRegistryConfig(c)
 	if err != nil {
 		return fmt.Errorf("Failed to convert repo entry to registry config: %s", err)
 	}
 
-	_, err = createOCIRegistryClient(registryConfig)
-	return err
+	ociRegistries.Lock()
+	ociRegistries.static[registryConfig.Host] = true
+	ociRegistries.Unlock()
+
+	if registryConfig.Username != "" && registryConfig.Password != "" {
+		return ociRegistries.login(registryConfig)
+	}
+
+	ociRegistries.Lock()
+	ociRegistries.configs[registryConfig.Host] = registryConfig
+	ociRegistries.Unlock()
+
+	return nil
+}
+
+// requestClient returns a registry client authenticating with per-request
+// credentials. It is not cached and the store is left untouched, the TLS
+// settings of a configured host apply unless the request sets its own.
+func (s *registryStore) requestClient(registryConfig *RegistryConfig) (*registry.Client, error) {
+	s.RLock()
+	c, ok := s.configs[registryConfig.Host]
+	s.RUnlock()
+	if ok && registryConfig.CertFile == "" && registryConfig.KeyFile == "" && registryConfig.CAFile == "" &&
+		!registryConfig.InsecureSkipTLSverify && !registryConfig.PlainHTTP {
+		requestConfig := *c
+		requestConfig.Username = registryConfig.Username
+		requestConfig.Password = registryConfig.Password
+		registryConfig = &requestConfig
+	}
+
+	return newOCIRegistryClient(registryConfig)
 }
 
 func createOCIRegistryClientForChartPathOptions(aimChart *string, chartPathOptions *action.ChartPathOptions) (*registry.Client, error) {
@@ -117,8 +373,193 @@ func createOCIRegistryClientForChartPathOptions(aimChart *string, chartPathOptio
 			return nil, fmt.Errorf("Failed to convert chart path options to registry config: %s", err)
 		}
 
-		return createOCIRegistryClient(registryConfig)
+		if registryConfig.Username != "" && registryConfig.Password != "" {
+			return ociRegistries.requestClient(registryConfig)
+		}
+
+		return ociRegistries.client(registryConfig)
 	}
 
 	return nil, nil
 }
+
+func listRegistries(c *gin.Context) {
+	respOK(c, ociRegistries.list())
+}
+
+func loginRegistry(c *gin.Context) {
+	var registryConfig RegistryConfig
+	err := c.ShouldBindJSON(&registryConfig)
+	if err != nil {
+		respErr(c, err)
+		return
+	}
+	registryConfig.Host = strings.TrimSuffix(strings.TrimPrefix(registryConfig.Host, "oci://"), "/")
+	if registryConfig.Host == "" {
+		respErr(c, fmt.Errorf("registry host can not be empty"))
+		return
+	}
+
+	err = ociRegistries.login(&registryConfig)
+	if err != nil {
+		respErr(c, err)
+		return
+	}
+
+	respOK(c, nil)
+}
+
+func logoutRegistry(c *gin.Context) {
+	host := strings.TrimSuffix(strings.TrimPrefix(c.Query("host"), "oci://"), "/")
+	if host == "" {
+		respErr(c, fmt.Errorf("registry host can not be empty"))
+		return
+	}
+
+	err := ociRegistries.logout(host)
+	if err != nil {
+		respErr(c, err)
+		return
+	}
+
+	respOK(c, nil)
+}
+
+type registryChartTags struct {
+	Ref   string          `json:"ref"`
+	Tags  []string        `json:"tags"`
+	Chart *chart.Metadata `json:"chart,omitempty"`
+}
+
+func listRegistryChartTags(c *gin.Context) {
+	ref := c.Query("ref")         // oci://host/path/chart
+	version := c.Query("version") // if set, return Chart.yaml of this tag
+
+	registryConfig, err := chartPathOptionsToRegistryConfig(&ref, &action.ChartPathOptions{})
+	if err != nil {
+		respErr(c, err)
+		return
+	}
+	registryClient, err := ociRegistries.client(registryConfig)
+	if err != nil {
+		respErr(c, err)
+		return
+	}
+
+	ref = strings.TrimPrefix(ref, "oci://")
+	tags, err := registryClient.Tags(ref)
+	if err != nil {
+		respErr(c, err)
+		return
+	}
+	result := &registryChartTags{
+		Ref:  ref,
+		Tags: tags,
+	}
+
+	if version != "" {
+		tag, err := registry.GetTagMatchingVersionOrConstraint(tags, version)
+		if err != nil {
+			respErr(c, err)
+			return
+		}
+		pullResult, err := registryClient.Pull(fmt.Sprintf("%s:%s", ref, tag), registry.PullOptWithChart(true))
+		if err != nil {
+			respErr(c, err)
+			return
+		}
+		result.Chart = pullResult.Chart.Meta
+	}
+
+	respOK(c, result)
+}
+
+type registryPushOptions struct {
+	Chart    string `json:"chart"`     // uploaded chart file, repo/chart or chart url
+	Version  string `json:"version"`   // --version, only for charts located in repositories
+	Remote   string `json:"remote"`    // oci://host/path
+	WithProv bool   `json:"with_prov"` // push the <chart>.prov file stored next to the chart
+}
+
+func pushRegistryChart(c *gin.Context) {
+	var options registryPushOptions
+	err := c.ShouldBindJSON(&options)
+	if err != nil {
+		respErr(c, err)
+		return
+	}
+	if options.Chart == "" {
+		respErr(c, fmt.Errorf("chart name can not be empty"))
+		return
+	}
+	remote := strings.TrimSuffix(options.Remote, "/")
+	if !strings.HasPrefix(remote, "oci://") {
+		respErr(c, fmt.Errorf("Invalid OCI registry URL: %s", options.Remote))
+		return
+	}
+
+	// local uploaded charts, <name>@<version>
+	name, err := resolveUploadedChart(options.Chart)
+	if err != nil {
+		respErr(c, err)
+		return
+	}
+
+	client := action.NewShow(action.ShowChart)
+	client.Version = options.Version
+	registryClient, err := createOCIRegistryClientForChartPathOptions(&name, &client.ChartPathOptions)
+	if err != nil {
+		respErr(c, err)
+		return
+	}
+	if registryClient != nil {
+		client.SetRegistryClient(registryClient)
+	}
+	cp, err := client.ChartPathOptions.LocateChart(name, settings)
+	if err != nil {
+		respErr(c, err)
+		return
+	}
+
+	chrt, err := loader.Load(cp)
+	if err != nil {
+		respErr(c, err)
+		return
+	}
+	data, err := os.ReadFile(cp)
+	if err != nil {
+		respErr(c, err)
+		return
+	}
+
+	pushOpts := []registry.PushOption{
+		registry.PushOptStrictMode(true),
+	}
+	if options.WithProv {
+		provData, err := os.ReadFile(cp + ".prov")
+		if err != nil {
+			respErr(c, fmt.Errorf("could not read provenance file of chart %s: %s", options.Chart, err))
+			return
+		}
+		pushOpts = append(pushOpts, registry.PushOptProvData(provData))
+	}
+
+	ref := fmt.Sprintf("%s/%s:%s", remote, chrt.Metadata.Name, chrt.Metadata.Version)
+	registryConfig, err := chartPathOptionsToRegistryConfig(&ref, &action.ChartPathOptions{})
+	if err != nil {
+		respErr(c, err)
+		return
+	}
+	pushClient, err := ociRegistries.client(registryConfig)
+	if err != nil {
+		respErr(c, err)
+		return
+	}
+	result, err := pushClient.Push(data, strings.TrimPrefix(ref, "oci://"), pushOpts...)
+	if err != nil {
+		respErr(c, err)
+		return
+	}
+
+	respOK(c, result)
+}
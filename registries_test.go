@@ -0,0 +1,395 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/distribution/distribution/v3/configuration"
+	_ "github.com/distribution/distribution/v3/registry/auth/htpasswd"
+	"github.com/distribution/distribution/v3/registry/handlers"
+	_ "github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chart/loader"
+	"helm.sh/helm/v3/pkg/chartutil"
+	"helm.sh/helm/v3/pkg/registry"
+	"helm.sh/helm/v3/pkg/repo"
+)
+
+const (
+	testRegistryUsername = "helm"
+	testRegistryPassword = "wrapper"
+)
+
+// newTestRegistry starts an in-memory OCI registry served over plain HTTP
+// and returns its host, with htpasswd auth if auth is set.
+func newTestRegistry(t *testing.T, auth bool) string {
+	t.Helper()
+
+	config := &configuration.Configuration{}
+	config.Log.Level = "error"
+	config.Storage = configuration.Storage{"inmemory": configuration.Parameters{}}
+	if auth {
+		hash, err := bcrypt.GenerateFromPassword([]byte(testRegistryPassword), bcrypt.DefaultCost)
+		if err != nil {
+			t.Fatal(err)
+		}
+		htpasswd := filepath.Join(t.TempDir(), "htpasswd")
+		err = os.WriteFile(htpasswd, []byte(fmt.Sprintf("%s:%s\n", testRegistryUsername, hash)), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config.Auth = configuration.Auth{
+			"htpasswd": configuration.Parameters{"realm": "localhost", "path": htpasswd},
+		}
+	}
+
+	// the registry client talks plain HTTP to loopback hosts regardless of
+	// PlainHTTP, serve on another address if the host has one
+	ip := "127.0.0.1"
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, addr := range addrs {
+			if n, ok := addr.(*net.IPNet); ok && !n.IP.IsLoopback() && n.IP.To4() != nil {
+				ip = n.IP.String()
+				break
+			}
+		}
+	}
+	l, err := net.Listen("tcp", ip+":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewUnstartedServer(handlers.NewApp(context.Background(), config))
+	srv.Listener.Close()
+	srv.Listener = l
+	srv.Start()
+	t.Cleanup(srv.Close)
+
+	return l.Addr().String()
+}
+
+// setupRegistryTest isolates the registry credentials and the registry
+// store of a test.
+func setupRegistryTest(t *testing.T) *gin.Engine {
+	t.Helper()
+
+	gin.SetMode(gin.TestMode)
+	logrus.SetOutput(io.Discard)
+	registryConfig := settings.RegistryConfig
+	settings.RegistryConfig = filepath.Join(t.TempDir(), "config.json")
+	store := ociRegistries
+	ociRegistries = &registryStore{
+		configs: map[string]*RegistryConfig{},
+		clients: map[string]*registry.Client{},
+		logins:  map[string]bool{},
+		static:  map[string]bool{},
+	}
+	t.Cleanup(func() {
+		settings.RegistryConfig = registryConfig
+		ociRegistries = store
+	})
+
+	router := gin.New()
+	RegisterRouter(router)
+
+	return router
+}
+
+func saveTestChart(t *testing.T, name, version string) string {
+	t.Helper()
+
+	chrt := &chart.Chart{
+		Metadata: &chart.Metadata{
+			APIVersion: chart.APIVersionV2,
+			Name:       name,
+			Version:    version,
+			Type:       "application",
+		},
+	}
+	cp, err := chartutil.Save(chrt, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return cp
+}
+
+func doRegistryRequest(t *testing.T, router *gin.Engine, method, path string, body interface{}) *respBody {
+	t.Helper()
+
+	var data []byte
+	if body != nil {
+		var err error
+		data, err = json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	req := httptest.NewRequest(method, path, bytes.NewReader(data))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("%s %s: status %d", method, path, w.Code)
+	}
+
+	resp := &respBody{}
+	if err := json.Unmarshal(w.Body.Bytes(), resp); err != nil {
+		t.Fatal(err)
+	}
+
+	return resp
+}
+
+func TestRegistryPushAndListTags(t *testing.T) {
+	tests := []struct {
+		name string
+		auth bool
+		// login logs in with these credentials, otherwise the host is
+		// configured without credentials
+		login     *RegistryConfig
+		plainHTTP bool
+		wantErr   string
+	}{
+		{
+			name:      "plain http",
+			plainHTTP: true,
+		},
+		{
+			name:      "https to a plain http registry",
+			plainHTTP: false,
+			wantErr:   "server gave HTTP response to HTTPS client",
+		},
+		{
+			name:      "auth without credentials",
+			auth:      true,
+			plainHTTP: true,
+			wantErr:   "authorization failed",
+		},
+		{
+			name:      "auth with wrong credentials",
+			auth:      true,
+			login:     &RegistryConfig{Username: testRegistryUsername, Password: "wrong"},
+			plainHTTP: true,
+			wantErr:   "Failed to login to registry",
+		},
+		{
+			name:      "auth with credentials",
+			auth:      true,
+			login:     &RegistryConfig{Username: testRegistryUsername, Password: testRegistryPassword},
+			plainHTTP: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			router := setupRegistryTest(t)
+			host := newTestRegistry(t, tt.auth)
+			if !tt.plainHTTP && strings.HasPrefix(host, "127.") {
+				t.Skip("no address other than loopback to serve the registry on")
+			}
+
+			if tt.login != nil {
+				login := *tt.login
+				login.Host = host
+				login.PlainHTTP = tt.plainHTTP
+				resp := doRegistryRequest(t, router, http.MethodPost, "/api/registries/login", login)
+				if resp.Code != 0 {
+					if tt.wantErr == "" || !strings.Contains(resp.Error, tt.wantErr) {
+						t.Fatalf("login: got error %q, want %q", resp.Error, tt.wantErr)
+					}
+					return
+				}
+			} else {
+				ociRegistries.configs[host] = &RegistryConfig{Host: host, PlainHTTP: tt.plainHTTP}
+			}
+
+			for _, version := range []string{"0.1.0", "0.2.0"} {
+				resp := doRegistryRequest(t, router, http.MethodPost, "/api/registries/charts/push", registryPushOptions{
+					Chart:  saveTestChart(t, "mychart", version),
+					Remote: "oci://" + host + "/charts",
+				})
+				if tt.wantErr != "" {
+					if resp.Code == 0 || !strings.Contains(resp.Error, tt.wantErr) {
+						t.Fatalf("push: got error %q, want %q", resp.Error, tt.wantErr)
+					}
+					return
+				}
+				if resp.Code != 0 {
+					t.Fatalf("push %s: %s", version, resp.Error)
+				}
+			}
+
+			resp := doRegistryRequest(t, router, http.MethodGet,
+				"/api/registries/charts/tags?ref=oci://"+host+"/charts/mychart&version=0.1.0", nil)
+			if resp.Code != 0 {
+				t.Fatalf("tags: %s", resp.Error)
+			}
+			data, _ := json.Marshal(resp.Data)
+			var result registryChartTags
+			if err := json.Unmarshal(data, &result); err != nil {
+				t.Fatal(err)
+			}
+			if got := strings.Join(result.Tags, ","); got != "0.2.0,0.1.0" {
+				t.Errorf("tags: got %s, want 0.2.0,0.1.0", got)
+			}
+			if result.Chart == nil || result.Chart.Version != "0.1.0" {
+				t.Errorf("chart: got %+v, want version 0.1.0", result.Chart)
+			}
+		})
+	}
+}
+
+func TestRegistryRequestCredentialsAreNotStored(t *testing.T) {
+	router := setupRegistryTest(t)
+	host := newTestRegistry(t, true)
+	resp := doRegistryRequest(t, router, http.MethodPost, "/api/registries/login", &RegistryConfig{
+		Host:      host,
+		Username:  testRegistryUsername,
+		Password:  testRegistryPassword,
+		PlainHTTP: true,
+	})
+	if resp.Code != 0 {
+		t.Fatalf("login: %s", resp.Error)
+	}
+	resp = doRegistryRequest(t, router, http.MethodPost, "/api/registries/charts/push", registryPushOptions{
+		Chart:  saveTestChart(t, "mychart", "0.1.0"),
+		Remote: "oci://" + host + "/charts",
+	})
+	if resp.Code != 0 {
+		t.Fatalf("push: %s", resp.Error)
+	}
+	stored := ociRegistries.clients[host]
+
+	ref := "oci://" + host + "/charts/mychart"
+	registryClient, err := createOCIRegistryClientForChartPathOptions(&ref, &action.ChartPathOptions{
+		Username: testRegistryUsername,
+		Password: "wrong",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if registryClient == stored {
+		t.Fatal("per-request credentials reused the client of the host")
+	}
+	if _, err := registryClient.Tags(strings.TrimPrefix(ref, "oci://")); err == nil {
+		t.Error("tags with wrong per-request credentials: expected an error")
+	}
+
+	if c := ociRegistries.configs[host]; c.Password != testRegistryPassword {
+		t.Errorf("stored password of %s was replaced by per-request credentials", host)
+	}
+	if ociRegistries.clients[host] != stored {
+		t.Errorf("stored client of %s was replaced", host)
+	}
+	if _, err := stored.Tags(strings.TrimPrefix(ref, "oci://")); err != nil {
+		t.Errorf("tags with the stored client: %s", err)
+	}
+}
+
+func TestRegistryLogoutKeepsConfiguredHosts(t *testing.T) {
+	router := setupRegistryTest(t)
+	configured := newTestRegistry(t, true)
+	loggedIn := newTestRegistry(t, true)
+	err := initRegistry(&repo.Entry{URL: "oci://" + configured, InsecureSkipTLSverify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var resp *respBody
+	for _, host := range []string{configured, loggedIn} {
+		resp = doRegistryRequest(t, router, http.MethodPost, "/api/registries/login", &RegistryConfig{
+			Host:      host,
+			Username:  testRegistryUsername,
+			Password:  testRegistryPassword,
+			PlainHTTP: true,
+		})
+		if resp.Code != 0 {
+			t.Fatalf("login %s: %s", host, resp.Error)
+		}
+	}
+
+	for _, host := range []string{configured, loggedIn} {
+		resp = doRegistryRequest(t, router, http.MethodDelete, "/api/registries/login?host="+host, nil)
+		if resp.Code != 0 {
+			t.Fatalf("logout %s: %s", host, resp.Error)
+		}
+	}
+
+	c, ok := ociRegistries.configs[configured]
+	if !ok {
+		t.Fatalf("config of the configured host %s was dropped", configured)
+	}
+	if c.Username != "" || c.Password != "" {
+		t.Errorf("credentials of %s outlived the logout", configured)
+	}
+	if !c.PlainHTTP {
+		t.Errorf("plain HTTP setting of %s was dropped", configured)
+	}
+	if ociRegistries.logins[configured] {
+		t.Errorf("%s is still logged in", configured)
+	}
+	if _, ok := ociRegistries.configs[loggedIn]; ok {
+		t.Errorf("config of %s outlived the logout", loggedIn)
+	}
+}
+
+func TestChartSourceOCIDependencyUsesRegistryStore(t *testing.T) {
+	router := setupRegistryTest(t)
+	host := newTestRegistry(t, true)
+	resp := doRegistryRequest(t, router, http.MethodPost, "/api/registries/login", &RegistryConfig{
+		Host:      host,
+		Username:  testRegistryUsername,
+		Password:  testRegistryPassword,
+		PlainHTTP: true,
+	})
+	if resp.Code != 0 {
+		t.Fatalf("login: %s", resp.Error)
+	}
+	resp = doRegistryRequest(t, router, http.MethodPost, "/api/registries/charts/push", registryPushOptions{
+		Chart:  saveTestChart(t, "dep", "0.1.0"),
+		Remote: "oci://" + host + "/charts",
+	})
+	if resp.Code != 0 {
+		t.Fatalf("push: %s", resp.Error)
+	}
+
+	chartDir := filepath.Join(t.TempDir(), "mychart")
+	err := chartutil.SaveDir(&chart.Chart{
+		Metadata: &chart.Metadata{
+			APIVersion: chart.APIVersionV2,
+			Name:       "mychart",
+			Version:    "0.1.0",
+			Dependencies: []*chart.Dependency{
+				{Name: "dep", Version: "0.1.0", Repository: "oci://" + host + "/charts"},
+			},
+		},
+	}, filepath.Dir(chartDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := packageChartSource(chartDir, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	chrt, err := loader.LoadArchive(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deps := chrt.Dependencies(); len(deps) != 1 || deps[0].Name() != "dep" {
+		t.Errorf("dependencies: got %v, want dep", deps)
+	}
+}
@@ -5,7 +5,6 @@ import (
 	"io"
 	"net/url"
 	"strconv"
-	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -68,6 +67,10 @@ type releaseOptions struct {
 	SetStringValues          []string `json:"set_string"`
 	ChartPathOptions
 
+	// install or upgrade
+	CheckAPIs   bool   `json:"check_apis"`   // refuse api versions removed in kube_version
+	KubeVersion string `json:"kube_version"` // default the version of the cluster
+
 	// only install
 	CreateNamespace  bool `json:"create_namespace"`
 	DependencyUpdate bool `json:"dependency_update"`
@@ -178,6 +181,17 @@ func mergeValues(options releaseOptions) (map[string]interface{}, error) {
 	return vals, nil
 }
 
+// respReleaseErr reports the findings of the api version gate along with the
+// error.
+func respReleaseErr(c *gin.Context, err error) {
+	var apiErr *removedAPIError
+	if errors.As(err, &apiErr) {
+		respErrWithData(c, err, apiErr.Findings)
+		return
+	}
+	respErr(c, err)
+}
+
 func getReleaseHistory(rls []*release.Release) (history releaseHistory) {
 	for i := len(rls) - 1; i >= 0; i-- {
 		r := rls[i]
@@ -239,11 +253,9 @@ func showReleaseInfo(c *gin.Context) {
 	name := c.Param("release")
 	namespace := c.Param("namespace")
 	info := c.Query("info")
-	kubeConfig := c.Query("kube_config")
 	if info == "" {
 		info = "values"
 	}
-	kubeContext := c.Query("kube_context")
 	infos := []string{"hooks", "manifest", "notes", "values"}
 	infoMap := map[string]bool{}
 	for _, i := range infos {
@@ -253,7 +265,7 @@ func showReleaseInfo(c *gin.Context) {
 		respErr(c, fmt.Errorf("bad info %s, release info only support hooks/manifest/notes/values", info))
 		return
 	}
-	actionConfig, err := actionConfigInit(InitKubeInformation(namespace, kubeContext, kubeConfig))
+	actionConfig, err := actionConfigInit(kubeInformation(c, namespace))
 	if err != nil {
 		respErr(c, err)
 		return
@@ -316,20 +328,12 @@ func installRelease(c *gin.Context) {
 	name := c.Param("release")
 	namespace := c.Param("namespace")
 	aimChart := c.Query("chart")
-	kubeContext := c.Query("kube_context")
-	kubeConfig := c.Query("kube_config")
 
 	if aimChart == "" {
 		respErr(c, fmt.Errorf("chart name can not be empty"))
 		return
 	}
 
-	// install with local uploaded charts, *.tgz
-	splitChart := strings.Split(aimChart, ".")
-	if splitChart[len(splitChart)-1] == "tgz" && !strings.Contains(aimChart, ":") {
-		aimChart = helmConfig.UploadPath + "/" + aimChart
-	}
-
 	var options releaseOptions
 	err := c.ShouldBindJSON(&options)
 	if err != nil && err != io.EOF {
@@ -337,22 +341,35 @@ func installRelease(c *gin.Context) {
 		return
 	}
 
-	if err = runInstall(name, namespace, kubeContext, aimChart, kubeConfig, options); err != nil {
+	// install with local uploaded charts, <name>@<version>
+	err = checkChartPolicy(aimChart, &options.ChartPathOptions)
+	if err != nil {
 		respErr(c, err)
 		return
 	}
+	aimChart, err = resolveUploadedChart(aimChart)
+	if err != nil {
+		respErr(c, err)
+		return
+	}
+
+	if err = runInstall(name, aimChart, kubeInformation(c, namespace), options); err != nil {
+		respReleaseErr(c, err)
+		return
+	}
 
 	respOK(c, err)
 	return
 }
 
-func runInstall(name, namespace, kubeContext, aimChart, kubeConfig string, options releaseOptions) (err error) {
+func runInstall(name, aimChart string, kubeInfo *KubeInformation, options releaseOptions) (err error) {
 	vals, err := mergeValues(options)
 	if err != nil {
 		return
 	}
 
-	actionConfig, err := actionConfigInit(InitKubeInformation(namespace, kubeContext, kubeConfig))
+	namespace := kubeInfo.AimNamespace
+	actionConfig, err := actionConfigInit(kubeInfo)
 	if err != nil {
 		return
 	}
@@ -392,6 +409,9 @@ func runInstall(name, namespace, kubeContext, aimChart, kubeConfig string, optio
 	client.ChartPathOptions.Username = options.ChartPathOptions.Username
 	client.ChartPathOptions.Verify = options.ChartPathOptions.Verify
 	client.ChartPathOptions.Version = options.ChartPathOptions.Version
+	if client.ChartPathOptions.Verify && client.ChartPathOptions.Keyring == "" {
+		client.ChartPathOptions.Keyring = provenanceConfig().Keyring
+	}
 
 	registryClient, err := createOCIRegistryClientForChartPathOptions(
 		&aimChart,
@@ -442,6 +462,19 @@ func runInstall(name, namespace, kubeContext, aimChart, kubeConfig string, optio
 		}
 	}
 
+	if options.CheckAPIs {
+		client.DryRun = true
+		var rls *release.Release
+		rls, err = client.Run(chartRequested, vals)
+		if err != nil {
+			return
+		}
+		if err = checkReleaseAPIs(actionConfig, rls, options.KubeVersion); err != nil {
+			return
+		}
+		client.DryRun = options.DryRun
+	}
+
 	_, err = client.Run(chartRequested, vals)
 	if err != nil {
 		return
@@ -453,8 +486,6 @@ func runInstall(name, namespace, kubeContext, aimChart, kubeConfig string, optio
 func uninstallRelease(c *gin.Context) {
 	name := c.Param("release")
 	namespace := c.Param("namespace")
-	kubeContext := c.Query("kube_context")
-	kubeConfig := c.Query("kube_config")
 
 	var options releaseUninstallOptions
 
@@ -464,7 +495,7 @@ func uninstallRelease(c *gin.Context) {
 		return
 	}
 
-	actionConfig, err := actionConfigInit(InitKubeInformation(namespace, kubeContext, kubeConfig))
+	actionConfig, err := actionConfigInit(kubeInformation(c, namespace))
 	if err != nil {
 		respErr(c, err)
 		return
@@ -492,8 +523,6 @@ func rollbackRelease(c *gin.Context) {
 	name := c.Param("release")
 	namespace := c.Param("namespace")
 	reversionStr := c.Param("reversion")
-	kubeContext := c.Query("kube_context")
-	kubeConfig := c.Query("kube_config")
 
 	reversion, err := strconv.Atoi(reversionStr)
 	if err != nil {
@@ -508,7 +537,7 @@ func rollbackRelease(c *gin.Context) {
 		return
 	}
 
-	actionConfig, err := actionConfigInit(InitKubeInformation(namespace, kubeContext, kubeConfig))
+	actionConfig, err := actionConfigInit(kubeInformation(c, namespace))
 	if err != nil {
 		respErr(c, err)
 		return
@@ -544,36 +573,50 @@ func upgradeRelease(c *gin.Context) {
 	name := c.Param("release")
 	namespace := c.Param("namespace")
 	aimChart := c.Query("chart")
-	kubeContext := c.Query("kube_context")
-	kubeConfig := c.Query("kube_config")
 
 	if aimChart == "" {
 		respErr(c, fmt.Errorf("chart name can not be empty"))
 		return
 	}
 
-	// upgrade with local uploaded charts *.tgz
-	splitChart := strings.Split(aimChart, ".")
-	if splitChart[len(splitChart)-1] == "tgz" {
-		aimChart = helmConfig.UploadPath + "/" + aimChart
-	}
-
 	var options releaseOptions
 	err := c.ShouldBindJSON(&options)
 	if err != nil && err != io.EOF {
 		respErr(c, err)
 		return
 	}
-	vals, err := mergeValues(options)
+
+	// upgrade with local uploaded charts, <name>@<version>
+	err = checkChartPolicy(aimChart, &options.ChartPathOptions)
 	if err != nil {
 		respErr(c, err)
 		return
 	}
-	actionConfig, err := actionConfigInit(InitKubeInformation(namespace, kubeContext, kubeConfig))
+	aimChart, err = resolveUploadedChart(aimChart)
 	if err != nil {
 		respErr(c, err)
 		return
 	}
+
+	if err = runUpgrade(name, aimChart, kubeInformation(c, namespace), options); err != nil {
+		respReleaseErr(c, err)
+		return
+	}
+
+	respOK(c, nil)
+}
+
+func runUpgrade(name, aimChart string, kubeInfo *KubeInformation, options releaseOptions) (err error) {
+	vals, err := mergeValues(options)
+	if err != nil {
+		return
+	}
+
+	namespace := kubeInfo.AimNamespace
+	actionConfig, err := actionConfigInit(kubeInfo)
+	if err != nil {
+		return
+	}
 	client := action.NewUpgrade(actionConfig)
 	client.Namespace = namespace
 
@@ -611,13 +654,15 @@ func upgradeRelease(c *gin.Context) {
 	client.ChartPathOptions.Username = options.ChartPathOptions.Username
 	client.ChartPathOptions.Verify = options.ChartPathOptions.Verify
 	client.ChartPathOptions.Version = options.ChartPathOptions.Version
+	if client.ChartPathOptions.Verify && client.ChartPathOptions.Keyring == "" {
+		client.ChartPathOptions.Keyring = provenanceConfig().Keyring
+	}
 
 	registryClient, err := createOCIRegistryClientForChartPathOptions(
 		&aimChart,
 		&client.ChartPathOptions,
 	)
 	if err != nil {
-		respErr(c, err)
 		return
 	}
 	if registryClient != nil {
@@ -626,18 +671,15 @@ func upgradeRelease(c *gin.Context) {
 
 	cp, err := client.ChartPathOptions.LocateChart(aimChart, settings)
 	if err != nil {
-		respErr(c, err)
 		return
 	}
 
 	chartRequested, err := loader.Load(cp)
 	if err != nil {
-		respErr(c, err)
 		return
 	}
 	if req := chartRequested.Metadata.Dependencies; req != nil {
-		if err := action.CheckDependencies(chartRequested, req); err != nil {
-			respErr(c, err)
+		if err = action.CheckDependencies(chartRequested, req); err != nil {
 			return
 		}
 	}
@@ -645,34 +687,36 @@ func upgradeRelease(c *gin.Context) {
 	if client.Install {
 		hisClient := action.NewHistory(actionConfig)
 		hisClient.Max = 1
-		if _, err := hisClient.Run(name); err == driver.ErrReleaseNotFound {
-			err = runInstall(name, namespace, kubeContext, aimChart, kubeConfig, options)
-			if err != nil {
-				respErr(c, err)
-				return
-			}
+		if _, err = hisClient.Run(name); err == driver.ErrReleaseNotFound {
+			return runInstall(name, aimChart, kubeInfo, options)
+		} else if err != nil {
+			return
+		}
+	}
 
-			respOK(c, err)
+	if options.CheckAPIs {
+		client.DryRun = true
+		var rls *release.Release
+		rls, err = client.Run(name, chartRequested, vals)
+		if err != nil {
 			return
-		} else if err != nil {
-			respErr(c, err)
+		}
+		if err = checkReleaseAPIs(actionConfig, rls, options.KubeVersion); err != nil {
 			return
 		}
+		client.DryRun = options.DryRun
 	}
 
 	_, err = client.Run(name, chartRequested, vals)
 	if err != nil {
-		respErr(c, err)
 		return
 	}
 
-	respOK(c, nil)
+	return nil
 }
 
 func listReleases(c *gin.Context) {
 	namespace := c.Param("namespace")
-	kubeContext := c.Query("kube_context")
-	kubeConfig := c.Query("kube_config")
 
 	var options releaseListOptions
 	err := c.ShouldBindJSON(&options)
@@ -683,12 +727,22 @@ func listReleases(c *gin.Context) {
 	if options.AllNamespaces {
 		namespace = ""
 	}
-	actionConfig, err := actionConfigInit(InitKubeInformation(namespace, kubeContext, kubeConfig))
+
+	elements, err := runListReleases(kubeInformation(c, namespace), options)
 	if err != nil {
 		respErr(c, err)
 		return
 	}
 
+	respOK(c, elements)
+}
+
+func runListReleases(kubeInfo *KubeInformation, options releaseListOptions) ([]releaseElement, error) {
+	actionConfig, err := actionConfigInit(kubeInfo)
+	if err != nil {
+		return nil, err
+	}
+
 	client := action.NewList(actionConfig)
 
 	// merge list options
@@ -709,8 +763,7 @@ func listReleases(c *gin.Context) {
 
 	results, err := client.Run()
 	if err != nil {
-		respErr(c, err)
-		return
+		return nil, err
 	}
 
 	// Initialize the array so no results returns an empty array instead of null
@@ -719,16 +772,14 @@ func listReleases(c *gin.Context) {
 		elements = append(elements, constructReleaseElement(r, false))
 	}
 
-	respOK(c, elements)
+	return elements, nil
 }
 
 func getReleaseStatus(c *gin.Context) {
 	name := c.Param("release")
 	namespace := c.Param("namespace")
-	kubeContext := c.Query("kube_context")
-	kubeConfig := c.Query("kube_config")
 
-	actionConfig, err := actionConfigInit(InitKubeInformation(namespace, kubeContext, kubeConfig))
+	actionConfig, err := actionConfigInit(kubeInformation(c, namespace))
 	if err != nil {
 		respErr(c, err)
 		return
@@ -748,10 +799,8 @@ func getReleaseStatus(c *gin.Context) {
 func listReleaseHistories(c *gin.Context) {
 	name := c.Param("release")
 	namespace := c.Param("namespace")
-	kubeContext := c.Query("kube_context")
-	kubeConfig := c.Query("kube_config")
 
-	actionConfig, err := actionConfigInit(InitKubeInformation(namespace, kubeContext, kubeConfig))
+	actionConfig, err := actionConfigInit(kubeInformation(c, namespace))
 	if err != nil {
 		respErr(c, err)
 		return
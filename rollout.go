@@ -0,0 +1,328 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/chartutil"
+	"helm.sh/helm/v3/pkg/release"
+	"helm.sh/helm/v3/pkg/storage/driver"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	rolloutPending        = "pending"
+	rolloutSucceeded      = "succeeded"
+	rolloutFailed         = "failed"
+	rolloutSkipped        = "skipped"
+	rolloutRolledBack     = "rolled_back"
+	rolloutRollbackFailed = "rollback_failed"
+)
+
+// rolloutTarget is a namespace of a cluster to upgrade, with values
+// overriding the ones of the release definition.
+type rolloutTarget struct {
+	releaseTarget
+	Values          string   `json:"values"`
+	SetValues       []string `json:"set"`
+	SetStringValues []string `json:"set_string"`
+}
+
+// rolloutRequest is a release definition and the ordered targets to upgrade
+// it in, batch_size targets per wave. The upgrade options of the release
+// definition apply to all targets.
+type rolloutRequest struct {
+	Release           string          `json:"release"`
+	Chart             string          `json:"chart"`
+	Targets           []rolloutTarget `json:"targets"`
+	BatchSize         int             `json:"batch_size"`          // default 1
+	RollbackOnFailure bool            `json:"rollback_on_failure"` // roll back completed targets
+	releaseOptions
+}
+
+type rolloutTargetStatus struct {
+	releaseTarget
+	Wave   int    `json:"wave"`
+	Status string `json:"status"`
+	// PreviousRevision is the revision a rollback returns to, 0 if the
+	// rollout installed the release
+	PreviousRevision int    `json:"previous_revision"`
+	Error            string `json:"error,omitempty"`
+}
+
+type rolloutReport struct {
+	Release string                 `json:"release"`
+	Chart   string                 `json:"chart"`
+	Status  string                 `json:"status"`
+	Targets []*rolloutTargetStatus `json:"targets"`
+}
+
+// targetOptions applies the values of a target on top of the values of the
+// release definition.
+func (t rolloutTarget) targetOptions(options releaseOptions) (releaseOptions, error) {
+	if t.Values == "" && len(t.SetValues) == 0 && len(t.SetStringValues) == 0 {
+		return options, nil
+	}
+
+	vals, err := mergeValues(options)
+	if err != nil {
+		return options, err
+	}
+	overrides, err := mergeValues(releaseOptions{
+		Values:          t.Values,
+		SetValues:       t.SetValues,
+		SetStringValues: t.SetStringValues,
+	})
+	if err != nil {
+		return options, err
+	}
+	values, err := yaml.Marshal(chartutil.MergeTables(overrides, vals))
+	if err != nil {
+		return options, err
+	}
+
+	options.Values = string(values)
+	options.SetValues = nil
+	options.SetStringValues = nil
+
+	return options, nil
+}
+
+// lastRevision returns the last deployed revision of a release, the
+// revision a rollback returns to. It is 0 if the release is not installed or
+// none of its revisions was deployed, a rollback uninstalls it then.
+func lastRevision(kubeInfo *KubeInformation, name string) (int, error) {
+	actionConfig, err := actionConfigInit(kubeInfo)
+	if err != nil {
+		return 0, err
+	}
+
+	return lastDeployedRevision(actionConfig, name)
+}
+
+func lastDeployedRevision(actionConfig *action.Configuration, name string) (int, error) {
+	history, err := actionConfig.Releases.History(name)
+	if errors.Is(err, driver.ErrReleaseNotFound) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	revision := 0
+	for _, rls := range history {
+		if rls.Info.Status == release.StatusDeployed && rls.Version > revision {
+			revision = rls.Version
+		}
+	}
+
+	return revision, nil
+}
+
+// rollbackTarget returns a target to its previous revision, or uninstalls
+// the release if the rollout installed it.
+func rollbackTarget(name string, kubeInfo *KubeInformation, revision int, options releaseOptions) error {
+	actionConfig, err := actionConfigInit(kubeInfo)
+	if err != nil {
+		return err
+	}
+	if options.Timeout == "" {
+		options.Timeout = defaultTimeout
+	}
+	timeout, err := time.ParseDuration(options.Timeout)
+	if err != nil {
+		return err
+	}
+
+	if revision == 0 {
+		client := action.NewUninstall(actionConfig)
+		client.Wait = options.Wait
+		client.Timeout = timeout
+		client.Description = "rollout rolled back"
+		_, err = client.Run(name)
+		return err
+	}
+
+	client := action.NewRollback(actionConfig)
+	client.Version = revision
+	client.Wait = options.Wait
+	client.Timeout = timeout
+	client.CleanupOnFail = options.CleanupOnFail
+	client.Force = options.Force
+	client.Recreate = options.Recreate
+	client.MaxHistory = options.MaxHistory
+
+	return client.Run(name)
+}
+
+// runRollout upgrades the release in the targets wave by wave. It halts on
+// the first failed wave, the targets of later waves are skipped.
+func runRollout(req *rolloutRequest, aimChart string) *rolloutReport {
+	report := &rolloutReport{
+		Release: req.Release,
+		Chart:   req.Chart,
+		Status:  rolloutSucceeded,
+	}
+	for i, target := range req.Targets {
+		report.Targets = append(report.Targets, &rolloutTargetStatus{
+			releaseTarget: target.releaseTarget,
+			Wave:          i/req.BatchSize + 1,
+			Status:        rolloutPending,
+		})
+	}
+
+	for start := 0; start < len(req.Targets); start += req.BatchSize {
+		end := start + req.BatchSize
+		if end > len(req.Targets) {
+			end = len(req.Targets)
+		}
+
+		var wg sync.WaitGroup
+		for i := start; i < end; i++ {
+			wg.Add(1)
+			go func(target rolloutTarget, status *rolloutTargetStatus) {
+				defer wg.Done()
+
+				kubeInfo := target.kubeInformation()
+				err := func() (err error) {
+					status.PreviousRevision, err = lastRevision(kubeInfo, req.Release)
+					if err != nil {
+						return
+					}
+					options, err := target.targetOptions(req.releaseOptions)
+					if err != nil {
+						return
+					}
+					return runUpgrade(req.Release, aimChart, kubeInfo, options)
+				}()
+				if err != nil {
+					status.Status = rolloutFailed
+					status.Error = err.Error()
+					return
+				}
+				status.Status = rolloutSucceeded
+			}(req.Targets[i], report.Targets[i])
+		}
+		wg.Wait()
+
+		for _, status := range report.Targets[start:end] {
+			if status.Status == rolloutFailed {
+				report.Status = rolloutFailed
+			}
+		}
+		if report.Status == rolloutFailed {
+			break
+		}
+	}
+
+	if report.Status != rolloutFailed {
+		return report
+	}
+	for _, status := range report.Targets {
+		if status.Status == rolloutPending {
+			status.Status = rolloutSkipped
+		}
+	}
+	if !req.RollbackOnFailure || req.DryRun {
+		return report
+	}
+
+	var wg sync.WaitGroup
+	for i, status := range report.Targets {
+		if status.Status != rolloutSucceeded {
+			continue
+		}
+		wg.Add(1)
+		go func(target rolloutTarget, status *rolloutTargetStatus) {
+			defer wg.Done()
+
+			kubeInfo := target.kubeInformation()
+			err := rollbackTarget(req.Release, kubeInfo, status.PreviousRevision, req.releaseOptions)
+			if err != nil {
+				status.Status = rolloutRollbackFailed
+				status.Error = err.Error()
+				return
+			}
+			status.Status = rolloutRolledBack
+		}(req.Targets[i], status)
+	}
+	wg.Wait()
+
+	return report
+}
+
+// rolloutRelease upgrades a release definition in several clusters and
+// namespaces in waves.
+func rolloutRelease(c *gin.Context) {
+	var req rolloutRequest
+	err := c.ShouldBindJSON(&req)
+	if err != nil {
+		respErr(c, err)
+		return
+	}
+	if req.Release == "" {
+		respErr(c, fmt.Errorf("release name can not be empty"))
+		return
+	}
+	if req.Chart == "" {
+		respErr(c, fmt.Errorf("chart name can not be empty"))
+		return
+	}
+	if len(req.Targets) == 0 {
+		respErr(c, fmt.Errorf("targets can not be empty"))
+		return
+	}
+	if req.BatchSize <= 0 {
+		req.BatchSize = 1
+	}
+	var wave map[releaseTarget]bool
+	for i, target := range req.Targets {
+		if i%req.BatchSize == 0 {
+			wave = map[releaseTarget]bool{}
+		}
+		// targets of a wave are upgraded concurrently
+		if wave[target.releaseTarget] {
+			respErr(c, fmt.Errorf("target %s is given twice in wave %d", target.releaseTarget, i/req.BatchSize+1))
+			return
+		}
+		wave[target.releaseTarget] = true
+		if target.Namespace == "" {
+			respErr(c, fmt.Errorf("namespace of target %s can not be empty", target.clusterTarget))
+			return
+		}
+		if target.Cluster != "" {
+			if _, err := managedClusters.registration(target.Cluster); err != nil {
+				respErr(c, err)
+				return
+			}
+		}
+	}
+
+	// upgrade with local uploaded charts, <name>@<version>
+	err = checkChartPolicy(req.Chart, &req.ChartPathOptions)
+	if err != nil {
+		respErr(c, err)
+		return
+	}
+	aimChart, err := resolveUploadedChart(req.Chart)
+	if err != nil {
+		respErr(c, err)
+		return
+	}
+
+	report := runRollout(&req, aimChart)
+	if report.Status == rolloutFailed {
+		for i, status := range report.Targets {
+			if status.Status == rolloutFailed {
+				respErrWithData(c, fmt.Errorf("rollout of %s failed on %s: %s", req.Release, req.Targets[i], status.Error), report)
+				return
+			}
+		}
+	}
+
+	respOK(c, report)
+}
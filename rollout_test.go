@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/release"
+	"helm.sh/helm/v3/pkg/storage"
+	"helm.sh/helm/v3/pkg/storage/driver"
+)
+
+func TestLastDeployedRevision(t *testing.T) {
+	tests := []struct {
+		name     string
+		statuses []release.Status // of revisions 1, 2, ...
+		want     int
+	}{
+		{name: "not installed"},
+		{
+			name:     "deployed",
+			statuses: []release.Status{release.StatusSuperseded, release.StatusDeployed},
+			want:     2,
+		},
+		{
+			name:     "failed upgrade",
+			statuses: []release.Status{release.StatusSuperseded, release.StatusDeployed, release.StatusFailed},
+			want:     2,
+		},
+		{
+			name:     "pending upgrade",
+			statuses: []release.Status{release.StatusDeployed, release.StatusPendingUpgrade},
+			want:     1,
+		},
+		{
+			name:     "failed install",
+			statuses: []release.Status{release.StatusFailed},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			actionConfig := &action.Configuration{Releases: storage.Init(driver.NewMemory())}
+			for i, status := range tt.statuses {
+				err := actionConfig.Releases.Create(&release.Release{
+					Name:      "web",
+					Namespace: "default",
+					Version:   i + 1,
+					Info:      &release.Info{Status: status},
+					Chart:     &chart.Chart{Metadata: &chart.Metadata{Name: "web", Version: "0.1.0"}},
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			got, err := lastDeployedRevision(actionConfig, "web")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got revision %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRolloutTargetOptions(t *testing.T) {
+	options := releaseOptions{
+		Values:    "replicaCount: 1\nimage: {tag: \"1.0\"}\n",
+		SetValues: []string{"image.pullPolicy=Always"},
+	}
+	target := rolloutTarget{
+		Values:    "replicaCount: 3\n",
+		SetValues: []string{"image.tag=2.0"},
+	}
+	got, err := target.targetOptions(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vals, err := mergeValues(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"replicaCount": float64(3),
+		"image":        map[string]interface{}{"tag": "2.0", "pullPolicy": "Always"},
+	}
+	data, _ := json.Marshal(vals)
+	vals = map[string]interface{}{}
+	if err := json.Unmarshal(data, &vals); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(vals, want) {
+		t.Errorf("got values %v, want %v", vals, want)
+	}
+
+	unchanged, err := rolloutTarget{}.targetOptions(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(unchanged, options) {
+		t.Errorf("a target without values changed the options: %+v", unchanged)
+	}
+}
+
+func TestRolloutRejectsDuplicateTargetsOfAWave(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	RegisterRouter(router)
+
+	tests := []struct {
+		name      string
+		batchSize int
+		targets   []rolloutTarget
+		wantErr   string
+	}{
+		{
+			name:      "same namespace twice in a wave",
+			batchSize: 2,
+			targets: []rolloutTarget{
+				{releaseTarget: releaseTarget{Namespace: "shop"}},
+				{releaseTarget: releaseTarget{Namespace: "shop"}},
+			},
+			wantErr: "target default cluster/shop is given twice in wave 1",
+		},
+		{
+			name:      "same namespace of a context twice in the second wave",
+			batchSize: 2,
+			targets: []rolloutTarget{
+				{releaseTarget: releaseTarget{Namespace: "shop"}},
+				{releaseTarget: releaseTarget{Namespace: "cart"}},
+				{releaseTarget: releaseTarget{clusterTarget: clusterTarget{KubeContext: "prod"}, Namespace: "shop"}},
+				{releaseTarget: releaseTarget{clusterTarget: clusterTarget{KubeContext: "prod"}, Namespace: "shop"}},
+			},
+			wantErr: "target context prod/shop is given twice in wave 2",
+		},
+		{
+			name:      "same namespace in different waves",
+			batchSize: 1,
+			targets: []rolloutTarget{
+				{releaseTarget: releaseTarget{Namespace: ""}},
+				{releaseTarget: releaseTarget{Namespace: ""}},
+			},
+			// passes the duplicate check and fails the next one
+			wantErr: "namespace of target default cluster can not be empty",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, err := json.Marshal(map[string]interface{}{
+				"release":    "web",
+				"chart":      "bitnami/nginx",
+				"batch_size": tt.batchSize,
+				"targets":    tt.targets,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			req := httptest.NewRequest(http.MethodPost, "/api/rollouts", bytes.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			resp := &respBody{}
+			if err := json.Unmarshal(w.Body.Bytes(), resp); err != nil {
+				t.Fatal(err)
+			}
+			if resp.Code == 0 || !strings.Contains(resp.Error, tt.wantErr) {
+				t.Errorf("got error %q, want %q", resp.Error, tt.wantErr)
+			}
+		})
+	}
+}
@@ -22,6 +22,17 @@ func respErr(c *gin.Context, err error) {
 	})
 }
 
+// respErrWithData reports an error together with details of the failure.
+func respErrWithData(c *gin.Context, err error, data interface{}) {
+	glog.Warningln(err)
+
+	c.JSON(http.StatusOK, &respBody{
+		Code:  1,
+		Data:  data,
+		Error: err.Error(),
+	})
+}
+
 func respOK(c *gin.Context, data interface{}) {
 	c.JSON(http.StatusOK, &respBody{
 		Code: 0,
@@ -47,19 +58,77 @@ func RegisterRouter(router *gin.Engine) {
 		repositories.PUT("", updateRepos)
 	}
 
+	// helm registry
+	registries := router.Group("/api/registries")
+	{
+		// list configured OCI registries
+		registries.GET("", listRegistries)
+		// helm registry login
+		registries.POST("/login", loginRegistry)
+		// helm registry logout
+		registries.DELETE("/login", logoutRegistry)
+		// list tags of an OCI chart
+		registries.GET("/charts/tags", listRegistryChartTags)
+		// helm push
+		registries.POST("/charts/push", pushRegistryChart)
+	}
+
 	// helm chart
 	charts := router.Group("/api/charts")
 	{
 		// helm show
 		charts.GET("", showChartInfo)
+		// values schema of a chart
+		charts.GET("/schema", getChartSchema)
+		// validate values against the schema of a chart
+		charts.POST("/validate-values", validateValues)
+		// compare two versions of a chart
+		charts.GET("/diff", compareChartVersions)
+		// images of a rendered chart
+		charts.POST("/images", listChartImages)
 		// upload chart
 		charts.POST("/upload", uploadChart)
 		// list uploaded charts
 		charts.GET("/upload", listUploadedCharts)
+		// upload unpackaged chart source
+		charts.POST("/upload/source", uploadChartSource)
 		// delete chart
 		charts.DELETE("/upload/:chart", deleteChart)
+		// ChartMuseum compatible upload
+		charts.POST("", postRepoChart)
+		// ChartMuseum compatible delete
+		charts.DELETE("/:name/:version", deleteRepoChart)
+	}
+
+	// chart repository of uploaded charts, helm repo add <name> http://<helm-wrapper>
+	router.GET("/index.yaml", getChartRepoIndex)
+	router.GET("/charts/:name/:file", downloadRepoChart)
+
+	// registered clusters
+	clusters := router.Group("/api/clusters")
+	{
+		// list clusters with their connectivity
+		clusters.GET("", listClusters)
+		// register cluster
+		clusters.POST("", registerCluster)
+		// remove cluster
+		clusters.DELETE("/:cluster", removeCluster)
 	}
 
+	// releases of all clusters
+	router.GET("/api/releases", listClusterReleases)
+	// upgrade a release in several clusters in waves
+	router.POST("/api/rollouts", rolloutRelease)
+	// compare a release across clusters and namespaces
+	router.POST("/api/releases/:release/compare", compareReleases)
+	// plan and apply a desired state of releases
+	router.POST("/api/reconcile/plan", planReconcile)
+	router.POST("/api/reconcile/apply", applyReconcile)
+	// last results of the periodic reconciliation of the release specs
+	router.GET("/api/reconcile/status", getReconcileStatus)
+	// drift states of the periodic drift check
+	router.GET("/api/drift", listLiveDrift)
+
 	// helm release
 	releases := router.Group("/api/namespaces/:namespace/releases")
 	{
@@ -79,5 +148,24 @@ func RegisterRouter(router *gin.Engine) {
 		releases.GET("/:release/status", getReleaseStatus)
 		// helm release history
 		releases.GET("/:release/histories", listReleaseHistories)
+		// images of a release
+		releases.GET("/:release/images", listReleaseImages)
+		// deprecated and removed api versions of a release
+		releases.GET("/:release/deprecations", listReleaseDeprecations)
+		// changes of the live objects of a release
+		releases.GET("/:release/drift", getReleaseLiveDrift)
+		// archive of all revisions of a release
+		releases.GET("/:release/backup", backupRelease)
 	}
+
+	// archive of all revisions of the releases of a namespace
+	router.GET("/api/namespaces/:namespace/backup", backupNamespace)
+	// restore release records from an archive
+	router.POST("/api/namespaces/:namespace/restore", restoreReleases)
+
+	// deployed releases of a namespace as a helmfile
+	router.GET("/api/namespaces/:namespace/helmfile", exportNamespaceHelmfile)
+
+	// images of the deployed releases of a namespace or the cluster
+	router.GET("/api/namespaces/:namespace/images", listNamespaceImages)
 }
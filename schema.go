@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/xeipuuv/gojsonschema"
+	"gopkg.in/yaml.v3"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chartutil"
+	sigsyaml "sigs.k8s.io/yaml"
+)
+
+const (
+	schemaSourceChart    = "chart"
+	schemaSourceInferred = "inferred"
+)
+
+type chartValuesSchema struct {
+	Source string      `json:"source"` // chart or inferred
+	Schema interface{} `json:"schema"`
+}
+
+type valuesValidationError struct {
+	Chart   string `json:"chart"`
+	Path    string `json:"path"`
+	Message string `json:"message"`
+}
+
+type valuesValidation struct {
+	Valid  bool                    `json:"valid"`
+	Errors []valuesValidationError `json:"errors"`
+}
+
+// chartValuesFile returns the raw values.yaml of a chart.
+func chartValuesFile(chrt *chart.Chart) []byte {
+	for _, f := range chrt.Raw {
+		if f.Name == chartutil.ValuesfileName {
+			return f.Data
+		}
+	}
+
+	return nil
+}
+
+// getChartValuesSchema returns the values.schema.json of the chart, or a
+// schema inferred from its default values.
+func getChartValuesSchema(chrt *chart.Chart) (*chartValuesSchema, error) {
+	if len(chrt.Schema) > 0 {
+		var schema interface{}
+		err := json.Unmarshal(chrt.Schema, &schema)
+		if err != nil {
+			return nil, fmt.Errorf("invalid values.schema.json: %s", err)
+		}
+		return &chartValuesSchema{
+			Source: schemaSourceChart,
+			Schema: schema,
+		}, nil
+	}
+
+	schema, err := inferValuesSchema(chartValuesFile(chrt))
+	if err != nil {
+		return nil, err
+	}
+
+	return &chartValuesSchema{
+		Source: schemaSourceInferred,
+		Schema: schema,
+	}, nil
+}
+
+// inferValuesSchema builds a JSON schema from a values.yaml: the types and
+// defaults come from the values, the descriptions from their comments.
+func inferValuesSchema(values []byte) (map[string]interface{}, error) {
+	var doc yaml.Node
+	err := yaml.Unmarshal(values, &doc)
+	if err != nil {
+		return nil, fmt.Errorf("failed parsing values: %s", err)
+	}
+
+	schema := map[string]interface{}{
+		"type":       "object",
+		"properties": map[string]interface{}{},
+	}
+	if doc.Kind == yaml.DocumentNode && len(doc.Content) > 0 && doc.Content[0].Kind == yaml.MappingNode {
+		schema = inferNodeSchema(doc.Content[0])
+	}
+	schema["$schema"] = "http://json-schema.org/draft-07/schema#"
+
+	return schema, nil
+}
+
+func inferNodeSchema(node *yaml.Node) map[string]interface{} {
+	schema := map[string]interface{}{}
+	switch node.Kind {
+	case yaml.AliasNode:
+		return inferNodeSchema(node.Alias)
+	case yaml.MappingNode:
+		properties := map[string]interface{}{}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			property := inferNodeSchema(value)
+			if description := nodeDescription(key, value); description != "" {
+				property["description"] = description
+			}
+			properties[key.Value] = property
+		}
+		schema["type"] = "object"
+		schema["properties"] = properties
+		return schema
+	case yaml.SequenceNode:
+		schema["type"] = "array"
+		if len(node.Content) > 0 {
+			schema["items"] = inferNodeSchema(node.Content[0])
+		}
+	case yaml.ScalarNode:
+		switch node.ShortTag() {
+		case "!!str", "!!binary", "!!timestamp":
+			schema["type"] = "string"
+		case "!!int":
+			schema["type"] = "integer"
+		case "!!float":
+			schema["type"] = "number"
+		case "!!bool":
+			schema["type"] = "boolean"
+		}
+	}
+
+	var value interface{}
+	if err := node.Decode(&value); err == nil && value != nil {
+		schema["default"] = value
+	}
+
+	return schema
+}
+
+// nodeDescription returns the comment of a values key. Comments written in
+// the helm-docs style ("# -- description") are preferred.
+func nodeDescription(key, value *yaml.Node) string {
+	comment := key.HeadComment
+	if comment == "" {
+		comment = key.LineComment
+	}
+	if comment == "" {
+		comment = value.LineComment
+	}
+	if comment == "" {
+		return ""
+	}
+
+	// only the paragraph right above the key
+	paragraphs := strings.Split(comment, "\n\n")
+	lines := strings.Split(paragraphs[len(paragraphs)-1], "\n")
+	for i := range lines {
+		lines[i] = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(lines[i]), "#"))
+	}
+	for i := len(lines) - 1; i >= 0; i-- {
+		if strings.HasPrefix(lines[i], "-- ") {
+			lines = lines[i:]
+			lines[0] = strings.TrimPrefix(lines[0], "-- ")
+			break
+		}
+	}
+
+	return strings.TrimSpace(strings.Join(lines, " "))
+}
+
+func getChartSchema(c *gin.Context) {
+	name := c.Query("chart")
+	if name == "" {
+		respErr(c, fmt.Errorf("chart name can not be empty"))
+		return
+	}
+
+	chrt, err := loadChart(name, c.Query("version"))
+	if err != nil {
+		respErr(c, err)
+		return
+	}
+
+	schema, err := getChartValuesSchema(chrt)
+	if err != nil {
+		respErr(c, err)
+		return
+	}
+
+	respOK(c, schema)
+}
+
+// validateChartValues coalesces the values with the chart defaults the way
+// install does, and checks them against the schemas of the chart and its
+// enabled subcharts.
+func validateChartValues(chrt *chart.Chart, vals map[string]interface{}) (*valuesValidation, error) {
+	err := chartutil.ProcessDependenciesWithMerge(chrt, vals)
+	if err != nil {
+		return nil, err
+	}
+	coalesced, err := chartutil.CoalesceValues(chrt, vals)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &valuesValidation{Errors: []valuesValidationError{}}
+	err = validateValuesSchema(chrt, coalesced, "", result)
+	if err != nil {
+		return nil, err
+	}
+	result.Valid = len(result.Errors) == 0
+
+	return result, nil
+}
+
+func validateValuesSchema(chrt *chart.Chart, values map[string]interface{}, prefix string, result *valuesValidation) error {
+	if len(chrt.Schema) > 0 {
+		data, err := sigsyaml.Marshal(values)
+		if err != nil {
+			return err
+		}
+		valuesJSON, err := sigsyaml.YAMLToJSON(data)
+		if err != nil {
+			return err
+		}
+		if bytes.Equal(valuesJSON, []byte("null")) {
+			valuesJSON = []byte("{}")
+		}
+
+		res, err := gojsonschema.Validate(gojsonschema.NewBytesLoader(chrt.Schema), gojsonschema.NewBytesLoader(valuesJSON))
+		if err != nil {
+			return fmt.Errorf("invalid values.schema.json of chart %s: %s", chrt.Name(), err)
+		}
+		for _, desc := range res.Errors() {
+			path := prefix
+			if field := desc.Field(); field != gojsonschema.STRING_CONTEXT_ROOT {
+				path += field
+			}
+			result.Errors = append(result.Errors, valuesValidationError{
+				Chart:   chrt.Name(),
+				Path:    strings.TrimSuffix(path, "."),
+				Message: desc.Description(),
+			})
+		}
+	}
+
+	for _, subchart := range chrt.Dependencies() {
+		subValues, _ := values[subchart.Name()].(map[string]interface{})
+		err := validateValuesSchema(subchart, subValues, prefix+subchart.Name()+".", result)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func validateValues(c *gin.Context) {
+	name := c.Query("chart")
+	if name == "" {
+		respErr(c, fmt.Errorf("chart name can not be empty"))
+		return
+	}
+
+	var options releaseOptions
+	err := c.ShouldBindJSON(&options)
+	if err != nil && err != io.EOF {
+		respErr(c, err)
+		return
+	}
+	version := c.Query("version")
+	if version == "" {
+		version = options.Version
+	}
+
+	vals, err := mergeValues(options)
+	if err != nil {
+		respErr(c, err)
+		return
+	}
+	chrt, err := loadChart(name, version)
+	if err != nil {
+		respErr(c, err)
+		return
+	}
+
+	result, err := validateChartValues(chrt, vals)
+	if err != nil {
+		respErr(c, err)
+		return
+	}
+
+	respOK(c, result)
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"helm.sh/helm/v3/pkg/downloader"
+	"helm.sh/helm/v3/pkg/provenance"
+)
+
+const (
+	chartVerified     = "verified"
+	chartUnsigned     = "unsigned"
+	chartUnverifiable = "unverifiable" // signed, but no keyring configured
+)
+
+type ProvenanceConfig struct {
+	// Keyring is the public keyring used to verify uploaded charts
+	Keyring string `yaml:"keyring"`
+	// SigningKeyring and KeyName select the key that signs packaged charts
+	SigningKeyring string `yaml:"signingKeyring"`
+	KeyName        string `yaml:"keyName"`
+	// PassphraseFile holds the passphrase of the signing key, it falls back
+	// to the HELM_KEY_PASSPHRASE environment variable
+	PassphraseFile string `yaml:"passphraseFile"`
+	// RequireVerified refuses to install or upgrade charts which are not
+	// verified, charts of repositories, URLs and OCI registries are verified
+	// against Keyring
+	RequireVerified bool `yaml:"requireVerified"`
+}
+
+type chartVerification struct {
+	Status   string   `json:"status"` // verified, unsigned or unverifiable
+	SignedBy []string `json:"signed_by,omitempty"`
+	FileHash string   `json:"file_hash,omitempty"`
+}
+
+func provenanceConfig() *ProvenanceConfig {
+	if helmConfig.Provenance == nil {
+		return &ProvenanceConfig{}
+	}
+
+	return helmConfig.Provenance
+}
+
+// withChartFiles writes a chart archive and its provenance file to a
+// temporary directory, named as the provenance file expects it.
+func withChartFiles(name, version string, data, provData []byte, fn func(chartPath string) error) error {
+	dir, err := os.MkdirTemp("", "helm-wrapper-prov-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	chartPath := filepath.Join(dir, fmt.Sprintf("%s-%s.tgz", name, version))
+	err = os.WriteFile(chartPath, data, 0644)
+	if err != nil {
+		return err
+	}
+	if provData != nil {
+		err = os.WriteFile(chartPath+".prov", provData, 0644)
+		if err != nil {
+			return err
+		}
+	}
+
+	return fn(chartPath)
+}
+
+// verifyChartProvenance checks the provenance file of a chart against the
+// configured keyring. A signature that does not verify is an error.
+func verifyChartProvenance(name, version string, data, provData []byte) (*chartVerification, error) {
+	if provData == nil {
+		return &chartVerification{Status: chartUnsigned}, nil
+	}
+	keyring := provenanceConfig().Keyring
+	if keyring == "" {
+		return &chartVerification{Status: chartUnverifiable}, nil
+	}
+
+	var verification *provenance.Verification
+	err := withChartFiles(name, version, data, provData, func(chartPath string) error {
+		var err error
+		verification, err = downloader.VerifyChart(chartPath, keyring)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("chart %s@%s failed provenance verification: %s", name, version, err)
+	}
+
+	result := &chartVerification{
+		Status:   chartVerified,
+		FileHash: verification.FileHash,
+	}
+	for identity := range verification.SignedBy.Identities {
+		result.SignedBy = append(result.SignedBy, identity)
+	}
+	sort.Strings(result.SignedBy)
+
+	return result, nil
+}
+
+// signChart creates a provenance file for a chart with the configured
+// signing key.
+func signChart(name, version string, data []byte) ([]byte, error) {
+	config := provenanceConfig()
+	if config.SigningKeyring == "" || config.KeyName == "" {
+		return nil, errors.New("no signing key configured")
+	}
+
+	signer, err := provenance.NewFromKeyring(config.SigningKeyring, config.KeyName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load signing key: %s", err)
+	}
+	if signer.Entity.PrivateKey != nil && signer.Entity.PrivateKey.Encrypted {
+		err = signer.DecryptKey(func(string) ([]byte, error) {
+			if config.PassphraseFile != "" {
+				passphrase, err := os.ReadFile(config.PassphraseFile)
+				if err != nil {
+					return nil, err
+				}
+				return []byte(strings.TrimRight(string(passphrase), "\r\n")), nil
+			}
+			return []byte(os.Getenv("HELM_KEY_PASSPHRASE")), nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt signing key: %s", err)
+		}
+	}
+
+	var sig string
+	err = withChartFiles(name, version, data, nil, func(chartPath string) error {
+		var err error
+		sig, err = signer.ClearSign(chartPath)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return []byte(sig), nil
+}
+
+// checkChartPolicy refuses uploaded charts which are not verified, if the
+// policy requires it. Charts of repositories, URLs and OCI registries are
+// verified against the configured keyring when they are located, so the
+// chart path options are set to verify them.
+func checkChartPolicy(ref string, options *ChartPathOptions) error {
+	config := provenanceConfig()
+	if !config.RequireVerified {
+		return nil
+	}
+	name, version, ok := parseUploadedChartRef(ref)
+	if !ok {
+		if config.Keyring == "" {
+			return fmt.Errorf("chart %s can not be verified without a keyring, installing unverified charts is not allowed", ref)
+		}
+		options.Verify = true
+		options.Keyring = config.Keyring
+		return nil
+	}
+
+	meta, err := getUploadedChartVersion(name, version)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("chart %s not found", ref)
+		}
+		return err
+	}
+	if meta.Verification == nil || meta.Verification.Status != chartVerified {
+		return fmt.Errorf("chart %s is not verified, installing unverified charts is not allowed", ref)
+	}
+
+	return nil
+}
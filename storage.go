@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	storageBackendLocal     = "local"
+	storageBackendS3        = "s3"
+	storageBackendConfigMap = "configmap"
+	storageBackendSecret    = "secret"
+)
+
+type StorageConfig struct {
+	// Backend is one of local, s3, configmap or secret, default local
+	Backend    string                   `yaml:"backend"`
+	S3         *S3StorageConfig         `yaml:"s3"`
+	Kubernetes *KubernetesStorageConfig `yaml:"kubernetes"`
+}
+
+// chartStorage stores the uploaded chart files by key, a slash separated
+// path like <name>/<name>-<version>.tgz. Get returns an error matching
+// fs.ErrNotExist for missing keys, Delete ignores them.
+type chartStorage interface {
+	Get(key string) ([]byte, error)
+	Put(key string, data []byte) error
+	Delete(key string) error
+	List(prefix string) ([]string, error)
+}
+
+var chartStore chartStorage
+
+func newChartStorage(config *StorageConfig) (chartStorage, error) {
+	if config == nil || config.Backend == "" || config.Backend == storageBackendLocal {
+		return newLocalChartStorage(helmConfig.UploadPath), nil
+	}
+
+	switch config.Backend {
+	case storageBackendS3:
+		if config.S3 == nil {
+			return nil, fmt.Errorf("storage backend s3 requires the s3 config")
+		}
+		return newS3ChartStorage(config.S3)
+	case storageBackendConfigMap, storageBackendSecret:
+		kubeConfig := config.Kubernetes
+		if kubeConfig == nil {
+			kubeConfig = &KubernetesStorageConfig{}
+		}
+		return newKubernetesChartStorage(kubeConfig, config.Backend == storageBackendSecret)
+	}
+
+	return nil, fmt.Errorf("unknown storage backend %s", config.Backend)
+}
+
+// localChartStorage keeps the charts below a directory on local disk.
+type localChartStorage struct {
+	root string
+}
+
+func newLocalChartStorage(root string) *localChartStorage {
+	return &localChartStorage{root: root}
+}
+
+func (s *localChartStorage) path(key string) string {
+	return filepath.Join(s.root, filepath.FromSlash(key))
+}
+
+func (s *localChartStorage) Get(key string) ([]byte, error) {
+	return os.ReadFile(s.path(key))
+}
+
+func (s *localChartStorage) Put(key string, data []byte) error {
+	p := s.path(key)
+	err := os.MkdirAll(filepath.Dir(p), 0755)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(p, data, 0644)
+}
+
+func (s *localChartStorage) Delete(key string) error {
+	p := s.path(key)
+	err := os.Remove(p)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	// drop the chart directory once its last file is gone
+	if dir := filepath.Dir(p); dir != filepath.Clean(s.root) {
+		_ = os.Remove(dir)
+	}
+
+	return nil
+}
+
+func (s *localChartStorage) List(prefix string) ([]string, error) {
+	keys := []string{}
+	err := filepath.WalkDir(s.root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(s.root, p)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+
+	return keys, err
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	kubeStorageLabel         = "helm-wrapper.opskumu.github.io/chart-storage"
+	kubeStorageKeyAnnotation = "helm-wrapper.opskumu.github.io/key"
+	kubeStorageDataKey       = "data"
+)
+
+type KubernetesStorageConfig struct {
+	// Namespace of the ConfigMaps/Secrets, default the helm namespace
+	Namespace string `yaml:"namespace"`
+	// NamePrefix of the ConfigMaps/Secrets, default helm-wrapper-chart
+	NamePrefix string `yaml:"namePrefix"`
+}
+
+// kubernetesChartStorage keeps every file in its own ConfigMap or Secret.
+// Objects are limited to 1MiB, so it only suits small charts.
+type kubernetesChartStorage struct {
+	client     kubernetes.Interface
+	namespace  string
+	namePrefix string
+	secret     bool
+}
+
+func newKubernetesChartStorage(config *KubernetesStorageConfig, secret bool) (*kubernetesChartStorage, error) {
+	restConfig, err := settings.RESTClientGetter().ToRESTConfig()
+	if err != nil {
+		return nil, err
+	}
+	client, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &kubernetesChartStorage{
+		client:     client,
+		namespace:  config.Namespace,
+		namePrefix: config.NamePrefix,
+		secret:     secret,
+	}
+	if s.namespace == "" {
+		s.namespace = settings.Namespace()
+	}
+	if s.namePrefix == "" {
+		s.namePrefix = "helm-wrapper-chart"
+	}
+
+	return s, nil
+}
+
+// objectName derives a valid object name from the key, the key itself is
+// kept in an annotation.
+func (s *kubernetesChartStorage) objectName(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return fmt.Sprintf("%s-%s", s.namePrefix, hex.EncodeToString(sum[:])[:20])
+}
+
+func (s *kubernetesChartStorage) objectMeta(key string) metav1.ObjectMeta {
+	return metav1.ObjectMeta{
+		Name:        s.objectName(key),
+		Namespace:   s.namespace,
+		Labels:      map[string]string{kubeStorageLabel: "true"},
+		Annotations: map[string]string{kubeStorageKeyAnnotation: key},
+	}
+}
+
+func (s *kubernetesChartStorage) Get(key string) ([]byte, error) {
+	ctx := context.Background()
+	var (
+		data []byte
+		err  error
+	)
+	if s.secret {
+		var secret *corev1.Secret
+		secret, err = s.client.CoreV1().Secrets(s.namespace).Get(ctx, s.objectName(key), metav1.GetOptions{})
+		if err == nil {
+			data = secret.Data[kubeStorageDataKey]
+		}
+	} else {
+		var cm *corev1.ConfigMap
+		cm, err = s.client.CoreV1().ConfigMaps(s.namespace).Get(ctx, s.objectName(key), metav1.GetOptions{})
+		if err == nil {
+			data = cm.BinaryData[kubeStorageDataKey]
+		}
+	}
+	if apierrors.IsNotFound(err) {
+		return nil, fmt.Errorf("%s: %w", key, fs.ErrNotExist)
+	}
+
+	return data, err
+}
+
+func (s *kubernetesChartStorage) Put(key string, data []byte) error {
+	ctx := context.Background()
+	if s.secret {
+		secret := &corev1.Secret{
+			ObjectMeta: s.objectMeta(key),
+			Type:       corev1.SecretTypeOpaque,
+			Data:       map[string][]byte{kubeStorageDataKey: data},
+		}
+		_, err := s.client.CoreV1().Secrets(s.namespace).Update(ctx, secret, metav1.UpdateOptions{})
+		if apierrors.IsNotFound(err) {
+			_, err = s.client.CoreV1().Secrets(s.namespace).Create(ctx, secret, metav1.CreateOptions{})
+		}
+		return err
+	}
+
+	cm := &corev1.ConfigMap{
+		ObjectMeta: s.objectMeta(key),
+		BinaryData: map[string][]byte{kubeStorageDataKey: data},
+	}
+	_, err := s.client.CoreV1().ConfigMaps(s.namespace).Update(ctx, cm, metav1.UpdateOptions{})
+	if apierrors.IsNotFound(err) {
+		_, err = s.client.CoreV1().ConfigMaps(s.namespace).Create(ctx, cm, metav1.CreateOptions{})
+	}
+
+	return err
+}
+
+func (s *kubernetesChartStorage) Delete(key string) error {
+	ctx := context.Background()
+	var err error
+	if s.secret {
+		err = s.client.CoreV1().Secrets(s.namespace).Delete(ctx, s.objectName(key), metav1.DeleteOptions{})
+	} else {
+		err = s.client.CoreV1().ConfigMaps(s.namespace).Delete(ctx, s.objectName(key), metav1.DeleteOptions{})
+	}
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+
+	return err
+}
+
+func (s *kubernetesChartStorage) List(prefix string) ([]string, error) {
+	ctx := context.Background()
+	opts := metav1.ListOptions{LabelSelector: kubeStorageLabel + "=true"}
+
+	var objects []metav1.ObjectMeta
+	if s.secret {
+		list, err := s.client.CoreV1().Secrets(s.namespace).List(ctx, opts)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range list.Items {
+			objects = append(objects, item.ObjectMeta)
+		}
+	} else {
+		list, err := s.client.CoreV1().ConfigMaps(s.namespace).List(ctx, opts)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range list.Items {
+			objects = append(objects, item.ObjectMeta)
+		}
+	}
+
+	keys := []string{}
+	for _, obj := range objects {
+		key := obj.Annotations[kubeStorageKeyAnnotation]
+		if key != "" && strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys, nil
+}
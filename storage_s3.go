@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+type S3StorageConfig struct {
+	// Endpoint of the S3 compatible service, e.g. https://s3.amazonaws.com
+	// or http://minio:9000
+	Endpoint        string `yaml:"endpoint"`
+	Region          string `yaml:"region"`
+	Bucket          string `yaml:"bucket"`
+	Prefix          string `yaml:"prefix"`
+	AccessKeyID     string `yaml:"accessKeyID"`
+	SecretAccessKey string `yaml:"secretAccessKey"`
+	// PathStyle forces path style bucket addressing, needed by most self
+	// hosted S3 compatible services
+	PathStyle bool `yaml:"pathStyle"`
+}
+
+// s3ChartStorage keeps the charts in a bucket of an S3 compatible object
+// storage.
+type s3ChartStorage struct {
+	client *minio.Client
+	bucket string
+	prefix string
+}
+
+func newS3ChartStorage(config *S3StorageConfig) (*s3ChartStorage, error) {
+	if config.Bucket == "" {
+		return nil, fmt.Errorf("s3 storage bucket can not be empty")
+	}
+	u, err := url.Parse(config.Endpoint)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid s3 storage endpoint %s", config.Endpoint)
+	}
+
+	creds := credentials.NewStaticV4(config.AccessKeyID, config.SecretAccessKey, "")
+	if config.AccessKeyID == "" {
+		creds = credentials.NewEnvAWS()
+	}
+	lookup := minio.BucketLookupAuto
+	if config.PathStyle {
+		lookup = minio.BucketLookupPath
+	}
+	client, err := minio.New(u.Host, &minio.Options{
+		Creds:        creds,
+		Secure:       u.Scheme == "https",
+		Region:       config.Region,
+		BucketLookup: lookup,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	exists, err := client.BucketExists(context.Background(), config.Bucket)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check s3 storage bucket %s: %s", config.Bucket, err)
+	}
+	if !exists {
+		return nil, fmt.Errorf("s3 storage bucket %s does not exist", config.Bucket)
+	}
+
+	return &s3ChartStorage{
+		client: client,
+		bucket: config.Bucket,
+		prefix: strings.Trim(config.Prefix, "/"),
+	}, nil
+}
+
+func (s *s3ChartStorage) objectName(key string) string {
+	if s.prefix == "" {
+		return key
+	}
+
+	return s.prefix + "/" + key
+}
+
+func (s *s3ChartStorage) Get(key string) ([]byte, error) {
+	obj, err := s.client.GetObject(context.Background(), s.bucket, s.objectName(key), minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	defer obj.Close()
+
+	data, err := io.ReadAll(obj)
+	if err != nil {
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return nil, fmt.Errorf("%s: %w", key, fs.ErrNotExist)
+		}
+		return nil, err
+	}
+
+	return data, nil
+}
+
+func (s *s3ChartStorage) Put(key string, data []byte) error {
+	_, err := s.client.PutObject(context.Background(), s.bucket, s.objectName(key),
+		bytes.NewReader(data), int64(len(data)), minio.PutObjectOptions{
+			ContentType: "application/octet-stream",
+		})
+
+	return err
+}
+
+func (s *s3ChartStorage) Delete(key string) error {
+	err := s.client.RemoveObject(context.Background(), s.bucket, s.objectName(key), minio.RemoveObjectOptions{})
+	if err != nil && minio.ToErrorResponse(err).Code == "NoSuchKey" {
+		return nil
+	}
+
+	return err
+}
+
+func (s *s3ChartStorage) List(prefix string) ([]string, error) {
+	keys := []string{}
+	objects := s.client.ListObjects(context.Background(), s.bucket, minio.ListObjectsOptions{
+		Prefix:    s.objectName(prefix),
+		Recursive: true,
+	})
+	for obj := range objects {
+		if obj.Err != nil {
+			return nil, obj.Err
+		}
+		key := obj.Key
+		if s.prefix != "" {
+			key = strings.TrimPrefix(key, s.prefix+"/")
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, nil
+}
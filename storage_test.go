@@ -0,0 +1,350 @@
+package main
+
+import (
+	"bufio"
+	"encoding/xml"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// fakeS3 is an in-memory stand-in of the S3 API subset used by the s3
+// storage: bucket lookup, object put, get, delete and ListObjectsV2, with
+// path style addressing.
+type fakeS3 struct {
+	sync.Mutex
+	bucket  string
+	objects map[string][]byte
+}
+
+type fakeS3Error struct {
+	XMLName xml.Name `xml:"Error"`
+	Code    string   `xml:"Code"`
+	Message string   `xml:"Message"`
+}
+
+type fakeS3Object struct {
+	Key          string `xml:"Key"`
+	Size         int    `xml:"Size"`
+	ETag         string `xml:"ETag"`
+	LastModified string `xml:"LastModified"`
+}
+
+type fakeS3ListResult struct {
+	XMLName     xml.Name       `xml:"ListBucketResult"`
+	Name        string         `xml:"Name"`
+	Prefix      string         `xml:"Prefix"`
+	KeyCount    int            `xml:"KeyCount"`
+	IsTruncated bool           `xml:"IsTruncated"`
+	Contents    []fakeS3Object `xml:"Contents"`
+}
+
+func (s *fakeS3) writeXML(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	_ = xml.NewEncoder(w).Encode(v)
+}
+
+func (s *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	if parts[0] != s.bucket {
+		s.writeXML(w, http.StatusNotFound, &fakeS3Error{Code: "NoSuchBucket", Message: parts[0]})
+		return
+	}
+	if len(parts) == 1 || parts[1] == "" {
+		switch {
+		case r.Method == http.MethodHead:
+			w.WriteHeader(http.StatusOK)
+		case r.Method == http.MethodGet && r.URL.Query().Get("list-type") == "2":
+			prefix := r.URL.Query().Get("prefix")
+			result := &fakeS3ListResult{Name: s.bucket, Prefix: prefix}
+			for key, data := range s.objects {
+				if strings.HasPrefix(key, prefix) {
+					result.Contents = append(result.Contents, fakeS3Object{
+						Key:          key,
+						Size:         len(data),
+						ETag:         `"etag"`,
+						LastModified: time.Now().UTC().Format(time.RFC3339),
+					})
+				}
+			}
+			sort.Slice(result.Contents, func(i, j int) bool {
+				return result.Contents[i].Key < result.Contents[j].Key
+			})
+			result.KeyCount = len(result.Contents)
+			s.writeXML(w, http.StatusOK, result)
+		default:
+			w.WriteHeader(http.StatusNotImplemented)
+		}
+		return
+	}
+
+	key := parts[1]
+	switch r.Method {
+	case http.MethodPut:
+		data, err := readS3Body(r)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		s.objects[key] = data
+		w.Header().Set("ETag", `"etag"`)
+		w.WriteHeader(http.StatusOK)
+	case http.MethodGet, http.MethodHead:
+		data, ok := s.objects[key]
+		if !ok {
+			s.writeXML(w, http.StatusNotFound, &fakeS3Error{Code: "NoSuchKey", Message: key})
+			return
+		}
+		w.Header().Set("ETag", `"etag"`)
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.WriteHeader(http.StatusOK)
+		if r.Method == http.MethodGet {
+			_, _ = w.Write(data)
+		}
+	case http.MethodDelete:
+		delete(s.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+	}
+}
+
+// readS3Body reads an object, decoding the aws-chunked encoding of signed
+// streaming uploads.
+func readS3Body(r *http.Request) ([]byte, error) {
+	if !strings.HasPrefix(r.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") {
+		return io.ReadAll(r.Body)
+	}
+
+	var data []byte
+	br := bufio.NewReader(r.Body)
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.ParseInt(strings.SplitN(strings.TrimSpace(line), ";", 2)[0], 16, 64)
+		if err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			return data, nil
+		}
+		chunk := make([]byte, size+2) // trailing \r\n
+		if _, err := io.ReadFull(br, chunk); err != nil {
+			return nil, err
+		}
+		data = append(data, chunk[:size]...)
+	}
+}
+
+func newTestS3ChartStorage(t *testing.T, prefix string) chartStorage {
+	t.Helper()
+
+	srv := httptest.NewServer(&fakeS3{bucket: "charts", objects: map[string][]byte{}})
+	t.Cleanup(srv.Close)
+
+	s, err := newS3ChartStorage(&S3StorageConfig{
+		Endpoint:        srv.URL,
+		Region:          "us-east-1",
+		Bucket:          "charts",
+		Prefix:          prefix,
+		AccessKeyID:     "access",
+		SecretAccessKey: "secret",
+		PathStyle:       true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return s
+}
+
+func TestChartStorage(t *testing.T) {
+	backends := []struct {
+		name    string
+		storage func(t *testing.T) chartStorage
+	}{
+		{
+			name: "local",
+			storage: func(t *testing.T) chartStorage {
+				return newLocalChartStorage(t.TempDir())
+			},
+		},
+		{
+			name: "s3",
+			storage: func(t *testing.T) chartStorage {
+				return newTestS3ChartStorage(t, "")
+			},
+		},
+		{
+			name: "s3 with prefix",
+			storage: func(t *testing.T) chartStorage {
+				return newTestS3ChartStorage(t, "/helm-wrapper/")
+			},
+		},
+		{
+			name: "configmap",
+			storage: func(t *testing.T) chartStorage {
+				return &kubernetesChartStorage{
+					client:     fake.NewSimpleClientset(),
+					namespace:  "default",
+					namePrefix: "helm-wrapper-chart",
+				}
+			},
+		},
+		{
+			name: "secret",
+			storage: func(t *testing.T) chartStorage {
+				return &kubernetesChartStorage{
+					client:     fake.NewSimpleClientset(),
+					namespace:  "default",
+					namePrefix: "helm-wrapper-chart",
+					secret:     true,
+				}
+			},
+		},
+	}
+
+	files := map[string]string{
+		"mychart/mychart-0.1.0.tgz":      "chart 0.1.0",
+		"mychart/mychart-0.2.0.tgz":      "chart 0.2.0",
+		"mychart/mychart-0.2.0.tgz.prov": "provenance 0.2.0",
+		"other/other-1.0.0.tgz":          "other 1.0.0",
+	}
+
+	tests := []struct {
+		name string
+		run  func(t *testing.T, s chartStorage)
+	}{
+		{
+			name: "put and get",
+			run: func(t *testing.T, s chartStorage) {
+				for key, data := range files {
+					got, err := s.Get(key)
+					if err != nil {
+						t.Fatalf("get %s: %s", key, err)
+					}
+					if string(got) != data {
+						t.Errorf("get %s: got %q, want %q", key, got, data)
+					}
+				}
+			},
+		},
+		{
+			name: "put overwrites",
+			run: func(t *testing.T, s chartStorage) {
+				key := "mychart/mychart-0.1.0.tgz"
+				if err := s.Put(key, []byte("replaced")); err != nil {
+					t.Fatal(err)
+				}
+				got, err := s.Get(key)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(got) != "replaced" {
+					t.Errorf("get %s: got %q, want %q", key, got, "replaced")
+				}
+			},
+		},
+		{
+			name: "get missing",
+			run: func(t *testing.T, s chartStorage) {
+				_, err := s.Get("mychart/mychart-9.9.9.tgz")
+				if !errors.Is(err, fs.ErrNotExist) {
+					t.Errorf("get missing: got %v, want fs.ErrNotExist", err)
+				}
+			},
+		},
+		{
+			name: "list",
+			run: func(t *testing.T, s chartStorage) {
+				want := map[string][]string{
+					"": {
+						"mychart/mychart-0.1.0.tgz",
+						"mychart/mychart-0.2.0.tgz",
+						"mychart/mychart-0.2.0.tgz.prov",
+						"other/other-1.0.0.tgz",
+					},
+					"mychart/": {
+						"mychart/mychart-0.1.0.tgz",
+						"mychart/mychart-0.2.0.tgz",
+						"mychart/mychart-0.2.0.tgz.prov",
+					},
+					"none/": {},
+				}
+				for prefix, keys := range want {
+					got, err := s.List(prefix)
+					if err != nil {
+						t.Fatalf("list %q: %s", prefix, err)
+					}
+					sort.Strings(got)
+					if !reflect.DeepEqual(got, keys) {
+						t.Errorf("list %q: got %v, want %v", prefix, got, keys)
+					}
+				}
+			},
+		},
+		{
+			name: "delete",
+			run: func(t *testing.T, s chartStorage) {
+				key := "mychart/mychart-0.2.0.tgz"
+				if err := s.Delete(key); err != nil {
+					t.Fatal(err)
+				}
+				if _, err := s.Get(key); !errors.Is(err, fs.ErrNotExist) {
+					t.Errorf("get deleted %s: got %v, want fs.ErrNotExist", key, err)
+				}
+				got, err := s.List("mychart/")
+				if err != nil {
+					t.Fatal(err)
+				}
+				sort.Strings(got)
+				want := []string{"mychart/mychart-0.1.0.tgz", "mychart/mychart-0.2.0.tgz.prov"}
+				if !reflect.DeepEqual(got, want) {
+					t.Errorf("list after delete: got %v, want %v", got, want)
+				}
+			},
+		},
+		{
+			name: "delete missing",
+			run: func(t *testing.T, s chartStorage) {
+				if err := s.Delete("mychart/mychart-9.9.9.tgz"); err != nil {
+					t.Errorf("delete missing: %s", err)
+				}
+			},
+		},
+	}
+
+	for _, backend := range backends {
+		t.Run(backend.name, func(t *testing.T) {
+			for _, tt := range tests {
+				t.Run(tt.name, func(t *testing.T) {
+					s := backend.storage(t)
+					for key, data := range files {
+						if err := s.Put(key, []byte(data)); err != nil {
+							t.Fatalf("put %s: %s", key, err)
+						}
+					}
+					tt.run(t, s)
+				})
+			}
+		})
+	}
+}
@@ -1,21 +1,548 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"net/http"
 	"os"
+	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/Masterminds/semver"
 	"github.com/gin-gonic/gin"
+	"github.com/golang/glog"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chart/loader"
+	"helm.sh/helm/v3/pkg/provenance"
 )
 
+var errChartVersionExists = errors.New("chart version already exists")
+
+// uploadedChartFilenamesKey maps the filenames charts were uploaded with to
+// their <name>@<version>, for clients which still use the filenames. Chart
+// names have no slash, so the key can't clash with the keys of a chart.
+const uploadedChartFilenamesKey = "filenames.json"
+
+// chartLocks serialises the stores and removals of the versions of a chart,
+// so an upload can't slip in between the existence check of another upload
+// and its put.
+var chartLocks = &keyedLocks{locks: map[string]*keyedLock{}}
+
+// uploadedChartFilenamesLock guards the read, modify and write of the
+// filename mapping.
+var uploadedChartFilenamesLock sync.Mutex
+
+type keyedLock struct {
+	sync.Mutex
+	refs int
+}
+
+type keyedLocks struct {
+	sync.Mutex
+	locks map[string]*keyedLock
+}
+
+// lock locks key and returns the function unlocking it.
+func (l *keyedLocks) lock(key string) func() {
+	l.Lock()
+	k, ok := l.locks[key]
+	if !ok {
+		k = &keyedLock{}
+		l.locks[key] = k
+	}
+	k.refs++
+	l.Unlock()
+
+	k.Lock()
+	return func() {
+		k.Unlock()
+		l.Lock()
+		k.refs--
+		if k.refs == 0 {
+			delete(l.locks, key)
+		}
+		l.Unlock()
+	}
+}
+
+// uploadedChartVersion is the metadata stored with every uploaded chart
+// archive, under the key <name>/<name>-<version>.json
+type uploadedChartVersion struct {
+	Name        string    `json:"name"`
+	Version     string    `json:"version"`
+	AppVersion  string    `json:"app_version"`
+	Description string    `json:"description"`
+	Digest      string    `json:"digest"`
+	Created     time.Time `json:"created"`
+	Uploader    string    `json:"uploader"`
+
+	Lint         []chartLintMessage `json:"lint,omitempty"`
+	Verification *chartVerification `json:"verification,omitempty"`
+	// Metadata is the Chart.yaml of the version, used for the repository index
+	Metadata *chart.Metadata `json:"metadata,omitempty"`
+}
+
+type chartUploadOptions struct {
+	Uploader string
+	Force    bool // overwrite an existing version
+	Lint     bool // run helm lint before storing the chart
+	Strict   bool // fail lint on warnings
+	Sign     bool // sign the chart with the server key if it has no provenance file
+}
+
+type uploadedChart struct {
+	Name     string                  `json:"name"`
+	Versions []*uploadedChartVersion `json:"versions"`
+}
+
+func uploadedChartKey(name, version string) string {
+	return fmt.Sprintf("%s/%s-%s.tgz", name, name, version)
+}
+
+func uploadedChartMetaKey(name, version string) string {
+	return fmt.Sprintf("%s/%s-%s.json", name, name, version)
+}
+
+// uploadedChartPath is where an uploaded chart is available on local disk,
+// charts of remote storage backends are cached there.
+func uploadedChartPath(name, version string) string {
+	return filepath.Join(helmConfig.UploadPath, filepath.FromSlash(uploadedChartKey(name, version)))
+}
+
+// isPathElement reports whether s can be used as a single file name below
+// the upload path.
+func isPathElement(s string) bool {
+	return s != "" && s != "." && s != ".." && s == filepath.Base(s)
+}
+
+// parseUploadedChartRef splits an uploaded chart reference <name>@<version>.
+// Repository charts (repo/chart), URLs and local paths are not references.
+func parseUploadedChartRef(ref string) (name, version string, ok bool) {
+	if strings.ContainsAny(ref, "/:") {
+		return "", "", false
+	}
+	i := strings.LastIndex(ref, "@")
+	if i <= 0 {
+		return "", "", false
+	}
+
+	return ref[:i], ref[i+1:], true
+}
+
+// isUploadedChartFilename reports whether ref is the filename of a chart
+// uploaded by filename, <file>.tgz.
+func isUploadedChartFilename(ref string) bool {
+	return strings.HasSuffix(ref, ".tgz") && isPathElement(ref) && !strings.ContainsAny(ref, ":@")
+}
+
+func loadUploadedChartFilenames() (map[string]string, error) {
+	filenames := map[string]string{}
+	data, err := chartStore.Get(uploadedChartFilenamesKey)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return filenames, nil
+		}
+		return nil, err
+	}
+	err = json.Unmarshal(data, &filenames)
+	if err != nil {
+		return nil, fmt.Errorf("corrupt chart filenames: %s", err)
+	}
+
+	return filenames, nil
+}
+
+// updateUploadedChartFilenames changes the filename mapping with update,
+// which reports whether it changed the mapping.
+func updateUploadedChartFilenames(update func(filenames map[string]string) bool) error {
+	uploadedChartFilenamesLock.Lock()
+	defer uploadedChartFilenamesLock.Unlock()
+
+	filenames, err := loadUploadedChartFilenames()
+	if err != nil {
+		return err
+	}
+	if !update(filenames) {
+		return nil
+	}
+	data, err := json.Marshal(filenames)
+	if err != nil {
+		return err
+	}
+
+	return chartStore.Put(uploadedChartFilenamesKey, data)
+}
+
+// uploadedChartFilenameRef returns the <name>@<version> of a chart uploaded
+// by filename.
+func uploadedChartFilenameRef(filename string) (string, error) {
+	filenames, err := loadUploadedChartFilenames()
+	if err != nil {
+		return "", err
+	}
+	ref, ok := filenames[filename]
+	if !ok {
+		return "", fmt.Errorf("chart %s not found", filename)
+	}
+
+	return ref, nil
+}
+
+// recordUploadedChartFilename maps the filename a chart was uploaded with
+// to its version.
+func recordUploadedChartFilename(filename, name, version string) error {
+	if !isUploadedChartFilename(filename) {
+		return nil
+	}
+
+	return updateUploadedChartFilenames(func(filenames map[string]string) bool {
+		filenames[filename] = name + "@" + version
+		return true
+	})
+}
+
+// resolveUploadedChart returns the archive path of an uploaded chart
+// reference, other chart names are returned unchanged. Charts of remote
+// storage backends are fetched into the upload path first.
+func resolveUploadedChart(ref string) (string, error) {
+	if isUploadedChartFilename(ref) {
+		versionRef, err := uploadedChartFilenameRef(ref)
+		if err != nil {
+			return "", err
+		}
+		glog.Warningf("chart %s is deprecated, use %s", ref, versionRef)
+		ref = versionRef
+	}
+	name, version, ok := parseUploadedChartRef(ref)
+	if !ok {
+		return ref, nil
+	}
+	if version == "" {
+		return "", fmt.Errorf("chart %s: version can not be empty", ref)
+	}
+	if !isPathElement(name) || !isPathElement(version) {
+		return "", fmt.Errorf("invalid chart reference %s", ref)
+	}
+
+	key := uploadedChartKey(name, version)
+	if ls, ok := chartStore.(*localChartStorage); ok {
+		cp := ls.path(key)
+		if _, err := os.Stat(cp); err != nil {
+			if os.IsNotExist(err) {
+				return "", fmt.Errorf("chart %s not found", ref)
+			}
+			return "", err
+		}
+		return cp, nil
+	}
+
+	data, err := chartStore.Get(key)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return "", fmt.Errorf("chart %s not found", ref)
+		}
+		return "", err
+	}
+	provData, err := chartStore.Get(key + ".prov")
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return "", err
+	}
+
+	cache := newLocalChartStorage(helmConfig.UploadPath)
+	err = cache.Put(key, data)
+	if err != nil {
+		return "", err
+	}
+	if provData != nil {
+		err = cache.Put(key+".prov", provData)
+	} else {
+		err = cache.Delete(key + ".prov")
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return cache.path(key), nil
+}
+
+func getUploadedChartVersion(name, version string) (*uploadedChartVersion, error) {
+	data, err := chartStore.Get(uploadedChartMetaKey(name, version))
+	if err != nil {
+		return nil, err
+	}
+	var meta uploadedChartVersion
+	err = json.Unmarshal(data, &meta)
+	if err != nil {
+		return nil, fmt.Errorf("corrupt chart metadata %s@%s: %s", name, version, err)
+	}
+
+	return &meta, nil
+}
+
+// saveUploadedChart validates a chart archive and stores it keyed by its
+// Chart.yaml name and version. An existing version is only replaced if
+// force is set.
+func saveUploadedChart(data, provData []byte, opts chartUploadOptions) (*uploadedChartVersion, error) {
+	chrt, err := loader.LoadArchive(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("invalid chart archive: %s", err)
+	}
+
+	return storeUploadedChart(chrt, data, provData, opts)
+}
+
+func storeUploadedChart(chrt *chart.Chart, data, provData []byte, opts chartUploadOptions) (*uploadedChartVersion, error) {
+	name, version := chrt.Metadata.Name, chrt.Metadata.Version
+	unlock := chartLocks.lock(name)
+	defer unlock()
+
+	if !opts.Force {
+		_, err := chartStore.Get(uploadedChartMetaKey(name, version))
+		if err == nil {
+			return nil, fmt.Errorf("%s@%s: %w", name, version, errChartVersionExists)
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+	}
+
+	var lintMessages []chartLintMessage
+	if opts.Lint {
+		var err error
+		lintMessages, err = lintChartArchive(data, opts.Strict)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.Sign && provData == nil {
+		var err error
+		provData, err = signChart(name, version, data)
+		if err != nil {
+			return nil, err
+		}
+	}
+	verification, err := verifyChartProvenance(name, version, data, provData)
+	if err != nil {
+		return nil, err
+	}
+
+	digest, err := provenance.Digest(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	meta := &uploadedChartVersion{
+		Name:         name,
+		Version:      version,
+		AppVersion:   chrt.Metadata.AppVersion,
+		Description:  chrt.Metadata.Description,
+		Digest:       digest,
+		Created:      time.Now(),
+		Uploader:     opts.Uploader,
+		Lint:         lintMessages,
+		Verification: verification,
+		Metadata:     chrt.Metadata,
+	}
+	metaData, err := json.Marshal(meta)
+	if err != nil {
+		return nil, err
+	}
+
+	key := uploadedChartKey(name, version)
+	err = chartStore.Put(key, data)
+	if err != nil {
+		return nil, err
+	}
+	if provData != nil {
+		err = chartStore.Put(key+".prov", provData)
+	} else {
+		// a replaced chart must not keep the provenance of the old archive
+		err = chartStore.Delete(key + ".prov")
+	}
+	if err != nil {
+		return nil, err
+	}
+	// the metadata goes last, it marks the version as complete
+	err = chartStore.Put(uploadedChartMetaKey(name, version), metaData)
+	if err != nil {
+		return nil, err
+	}
+	refreshChartRepoIndex()
+
+	return meta, nil
+}
+
+// removeUploadedChart deletes one version of a chart, or all of its
+// versions if version is empty. Missing charts are not an error.
+func removeUploadedChart(name, version string) error {
+	if !isPathElement(name) || (version != "" && !isPathElement(version)) {
+		return fmt.Errorf("invalid chart %s@%s", name, version)
+	}
+	unlock := chartLocks.lock(name)
+	defer unlock()
+
+	var keys []string
+	if version == "" {
+		var err error
+		keys, err = chartStore.List(name + "/")
+		if err != nil {
+			return err
+		}
+	} else {
+		key := uploadedChartKey(name, version)
+		keys = []string{uploadedChartMetaKey(name, version), key, key + ".prov"}
+	}
+	cache := newLocalChartStorage(helmConfig.UploadPath)
+	for _, key := range keys {
+		err := chartStore.Delete(key)
+		if err != nil {
+			return err
+		}
+		if _, ok := chartStore.(*localChartStorage); !ok {
+			_ = cache.Delete(key)
+		}
+	}
+	refreshChartRepoIndex()
+
+	return updateUploadedChartFilenames(func(filenames map[string]string) bool {
+		changed := false
+		for filename, ref := range filenames {
+			n, v, _ := parseUploadedChartRef(ref)
+			if n == name && (version == "" || v == version) {
+				delete(filenames, filename)
+				changed = true
+			}
+		}
+		return changed
+	})
+}
+
+func listUploadedChartVersions() ([]*uploadedChart, error) {
+	keys, err := chartStore.List("")
+	if err != nil {
+		return nil, err
+	}
+
+	chartMap := map[string]*uploadedChart{}
+	for _, key := range keys {
+		if !strings.HasSuffix(key, ".json") || strings.Count(key, "/") != 1 {
+			continue
+		}
+		data, err := chartStore.Get(key)
+		if err != nil {
+			return nil, err
+		}
+		var meta uploadedChartVersion
+		err = json.Unmarshal(data, &meta)
+		if err != nil {
+			glog.Warningf("skip corrupt chart metadata %s: %s", key, err)
+			continue
+		}
+		if _, ok := chartMap[meta.Name]; !ok {
+			chartMap[meta.Name] = &uploadedChart{Name: meta.Name}
+		}
+		chartMap[meta.Name].Versions = append(chartMap[meta.Name].Versions, &meta)
+	}
+
+	charts := make([]*uploadedChart, 0, len(chartMap))
+	for _, c := range chartMap {
+		sort.Slice(c.Versions, func(i, j int) bool {
+			vi, erri := semver.NewVersion(c.Versions[i].Version)
+			vj, errj := semver.NewVersion(c.Versions[j].Version)
+			if erri != nil || errj != nil {
+				return c.Versions[i].Version > c.Versions[j].Version
+			}
+			return vi.GreaterThan(vj)
+		})
+		charts = append(charts, c)
+	}
+	sort.Slice(charts, func(i, j int) bool {
+		return charts[i].Name < charts[j].Name
+	})
+
+	return charts, nil
+}
+
+// migrateUploadedCharts moves charts uploaded by filename into the
+// versioned chart storage, their filenames stay usable as chart names.
+func migrateUploadedCharts() error {
+	files, err := filepath.Glob(filepath.Join(helmConfig.UploadPath, "*.tgz"))
+	if err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			return err
+		}
+		chrt, err := loader.LoadArchive(bytes.NewReader(data))
+		if err != nil {
+			glog.Warningf("skip migrating chart %s: invalid chart archive: %s", f, err)
+			continue
+		}
+		_, err = storeUploadedChart(chrt, data, nil, chartUploadOptions{})
+		if err != nil && !errors.Is(err, errChartVersionExists) {
+			glog.Warningf("skip migrating chart %s: %s", f, err)
+			continue
+		}
+		name, version := chrt.Metadata.Name, chrt.Metadata.Version
+		err = recordUploadedChartFilename(filepath.Base(f), name, version)
+		if err != nil {
+			return err
+		}
+		glog.Infof("migrated chart %s to %s@%s", f, name, version)
+		err = os.Remove(f)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func chartUploadOptionsFromRequest(c *gin.Context) chartUploadOptions {
+	opts := chartUploadOptions{
+		Uploader: c.PostForm("uploader"),
+		Force:    c.Query("force") == "true" || c.PostForm("force") == "true",
+		Lint:     c.Query("lint") == "true" || c.PostForm("lint") == "true",
+		Strict:   c.Query("strict") == "true" || c.PostForm("strict") == "true",
+	}
+	if opts.Uploader == "" {
+		opts.Uploader = c.ClientIP()
+	}
+
+	return opts
+}
+
+// respUploadErr reports a failed upload, with the lint messages if the chart
+// did not pass lint.
+func respUploadErr(c *gin.Context, err error) {
+	var lintErr *chartLintError
+	if errors.As(err, &lintErr) {
+		respErrWithData(c, err, lintErr.Messages)
+		return
+	}
+	if errors.Is(err, errChartVersionExists) {
+		err = fmt.Errorf("%s, use force to overwrite it", err)
+	}
+	respErr(c, err)
+}
+
 func uploadChart(c *gin.Context) {
 	file, header, err := c.Request.FormFile("chart")
 	if err != nil {
 		respErr(c, err)
 		return
 	}
+	defer file.Close()
 
 	filename := header.Filename
 	t := strings.Split(filename, ".")
@@ -24,57 +551,69 @@ func uploadChart(c *gin.Context) {
 		return
 	}
 
-	out, err := os.Create(helmConfig.UploadPath + "/" + filename)
+	data, err := io.ReadAll(file)
 	if err != nil {
 		respErr(c, err)
 		return
 	}
-	defer out.Close()
+	provData, err := readFormFile(c, "prov")
+	if err != nil && err != http.ErrMissingFile {
+		respErr(c, err)
+		return
+	}
 
-	_, err = io.Copy(out, file)
+	meta, err := saveUploadedChart(data, provData, chartUploadOptionsFromRequest(c))
+	if err != nil {
+		respUploadErr(c, err)
+		return
+	}
+	err = recordUploadedChartFilename(filepath.Base(filename), meta.Name, meta.Version)
 	if err != nil {
 		respErr(c, err)
 		return
 	}
 
-	respOK(c, nil)
+	respOK(c, meta)
 }
 
 func listUploadedCharts(c *gin.Context) {
-	charts := []string{}
-	files, err := os.ReadDir(helmConfig.UploadPath)
+	charts, err := listUploadedChartVersions()
 	if err != nil {
 		respErr(c, err)
 		return
 	}
-	for _, f := range files {
-		t := strings.Split(f.Name(), ".")
-		if t[len(t)-1] == "tgz" {
-			charts = append(charts, f.Name())
-		}
-	}
 
 	respOK(c, charts)
 }
 
 func deleteChart(c *gin.Context) {
-	chart := c.Param("chart")
+	chart := c.Param("chart") // <name>@<version>, or <name> for all versions
 	if chart == "" {
 		err := errors.New("chart must be not empty")
 		respErr(c, err)
 		return
 	}
-
-	filePath := helmConfig.UploadPath + "/" + chart
-	// not exist,ok
-	_, err := os.Stat(filePath)
-	if err != nil || os.IsNotExist(err) {
-		respOK(c, nil)
-		return
+	// deprecated, the filename of a chart uploaded by filename
+	if isUploadedChartFilename(chart) {
+		filenames, err := loadUploadedChartFilenames()
+		if err != nil {
+			respErr(c, err)
+			return
+		}
+		ref, ok := filenames[chart]
+		if !ok {
+			respOK(c, nil)
+			return
+		}
+		glog.Warningf("chart %s is deprecated, use %s", chart, ref)
+		chart = ref
 	}
 
-	//delete chart from disk
-	err = os.Remove(filePath)
+	name, version, ok := parseUploadedChartRef(chart)
+	if !ok {
+		name = chart
+	}
+	err := removeUploadedChart(name, version)
 	if err != nil {
 		respErr(c, err)
 		return
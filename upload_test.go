@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// setupUploadTest stores the uploaded charts of a test in a temporary
+// upload path.
+func setupUploadTest(t *testing.T) string {
+	t.Helper()
+
+	gin.SetMode(gin.TestMode)
+	logrus.SetOutput(io.Discard)
+	dir := t.TempDir()
+	uploadPath, store := helmConfig.UploadPath, chartStore
+	helmConfig.UploadPath = dir
+	chartStore = newLocalChartStorage(dir)
+	t.Cleanup(func() {
+		helmConfig.UploadPath = uploadPath
+		chartStore = store
+	})
+
+	return dir
+}
+
+func TestSaveUploadedChartConcurrently(t *testing.T) {
+	setupUploadTest(t)
+	data, err := os.ReadFile(saveTestChart(t, "mychart", "0.1.0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const uploads = 16
+	errs := make([]error, uploads)
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < uploads; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			// lint widens the window between the existence check and the put
+			_, errs[i] = saveUploadedChart(data, nil, chartUploadOptions{Uploader: "test", Lint: true})
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+
+	stored := 0
+	for _, err := range errs {
+		switch {
+		case err == nil:
+			stored++
+		case !errors.Is(err, errChartVersionExists):
+			t.Errorf("unexpected error %s", err)
+		}
+	}
+	if stored != 1 {
+		t.Errorf("stored the version %d times, want once", stored)
+	}
+}
+
+func TestUploadedChartFilenames(t *testing.T) {
+	dir := setupUploadTest(t)
+	data, err := os.ReadFile(saveTestChart(t, "mychart", "0.1.0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "mychart.tgz"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := migrateUploadedCharts(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "mychart.tgz")); !os.IsNotExist(err) {
+		t.Errorf("the migrated chart file is still there: %v", err)
+	}
+	cp, err := resolveUploadedChart("mychart.tgz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := uploadedChartPath("mychart", "0.1.0"); cp != want {
+		t.Errorf("got path %s, want %s", cp, want)
+	}
+	if _, err := resolveUploadedChart("other.tgz"); err == nil {
+		t.Error("unknown filename: expected an error")
+	}
+
+	router := gin.New()
+	RegisterRouter(router)
+	resp := doRegistryRequest(t, router, http.MethodDelete, "/api/charts/upload/mychart.tgz", nil)
+	if resp.Code != 0 {
+		t.Fatalf("delete: %s", resp.Error)
+	}
+	if _, err := chartStore.Get(uploadedChartKey("mychart", "0.1.0")); !os.IsNotExist(err) {
+		t.Errorf("the deleted chart is still stored: %v", err)
+	}
+	if _, err := resolveUploadedChart("mychart.tgz"); err == nil {
+		t.Error("filename of a deleted chart: expected an error")
+	}
+}